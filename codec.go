@@ -0,0 +1,139 @@
+package mry
+
+import (
+	"bytes"
+	"code.google.com/p/snappy-go/snappy"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Encodes row data between the marshalling of its value and the storage.
+// Encoded rows start with a header recording the codec used, so that rows
+// stay readable when the codec changes.
+type Codec interface {
+	// Identifier recorded in the header of encoded rows, 0 and 255 being
+	// reserved
+	Id() byte
+
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// A marshalled value never starts with a 0 byte, since 0 isn't a valid
+// protobuf field number. Rows written without codec are thus told apart
+// from encoded ones starting with this marker followed by the codec id.
+const codecHeaderMarker byte = 0
+
+var (
+	GzipCodec   Codec = gzipCodec{}
+	SnappyCodec Codec = snappyCodec{}
+)
+
+var (
+	codecsMutex sync.RWMutex
+	codecs      = map[byte]Codec{
+		GzipCodec.Id():   GzipCodec,
+		SnappyCodec.Id(): SnappyCodec,
+	}
+)
+
+// Makes a codec available to decode rows. Panics if its id is reserved, 0
+// marking headers and 255 encrypted rows, or already used by another codec.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	if codec.Id() == codecHeaderMarker || codec.Id() == encryptedCodecId {
+		panic(fmt.Sprintf("mry: codec id %d is reserved", codec.Id()))
+	}
+	if _, found := codecs[codec.Id()]; found {
+		panic(fmt.Sprintf("mry: codec id %d is already registered", codec.Id()))
+	}
+	codecs[codec.Id()] = codec
+}
+
+// Encodes row data with the codec, if any
+func encodeRowData(codec Codec, data []byte) ([]byte, error) {
+	if codec == nil {
+		return data, nil
+	}
+
+	encoded, err := codec.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{codecHeaderMarker, codec.Id()}, encoded...), nil
+}
+
+// Decodes row data with the codec recorded in its header, if any
+func decodeRowData(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != codecHeaderMarker {
+		return data, nil
+	}
+
+	if len(data) < 2 {
+		return nil, errors.New("Row data has a truncated codec header")
+	}
+
+	codecsMutex.RLock()
+	codec, found := codecs[data[1]]
+	codecsMutex.RUnlock()
+
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Row data is encoded with unknown codec %d", data[1]))
+	}
+	return codec.Decode(data[2:])
+}
+
+type gzipCodec struct {
+}
+
+func (c gzipCodec) Id() byte {
+	return 1
+}
+
+func (c gzipCodec) Encode(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (c gzipCodec) Decode(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+type snappyCodec struct {
+}
+
+func (c snappyCodec) Id() byte {
+	return 2
+}
+
+func (c snappyCodec) Encode(data []byte) ([]byte, error) {
+	return snappy.Encode(nil, data)
+}
+
+func (c snappyCodec) Decode(data []byte) ([]byte, error) {
+	return snappy.Decode(nil, data)
+}
@@ -0,0 +1,39 @@
+package mry
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("repetitive data "), 100)
+
+	for _, codec := range []Codec{GzipCodec, SnappyCodec} {
+		encoded, err := encodeRowData(codec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoded[0] != codecHeaderMarker || encoded[1] != codec.Id() {
+			t.Fatalf("Expected header of codec %d, got %v", codec.Id(), encoded[:2])
+		}
+
+		decoded, err := decodeRowData(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Fatalf("Codec %d didn't decode to original data", codec.Id())
+		}
+	}
+
+	// data written without codec is read as is
+	decoded, err := decodeRowData(data)
+	if err != nil || !bytes.Equal(decoded, data) {
+		t.Fatalf("Data without header should be read as is, got %v", err)
+	}
+
+	_, err = decodeRowData([]byte{codecHeaderMarker, 200, 1})
+	if err == nil {
+		t.Fatalf("Decoding with an unknown codec should fail")
+	}
+}
@@ -0,0 +1,288 @@
+package mry
+
+import (
+	"bufio"
+	pb "code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"io"
+	"time"
+)
+
+// Number of versions read at once from a table's timeline while dumping
+const dumpBatchSize = 1000
+
+// Number of rows written at once while restoring, if the storage's
+// transactions can write versions at different times
+const restoreBatchSize = 1000
+
+// Bytes of a dumped row added to its data, for its table and keys
+const dumpRowOverhead = 64 * 1024
+
+type DumpOptions struct {
+	// Dumps every stored version of rows, deletions included, instead of
+	// only the latest version of existing rows
+	AllVersions bool
+
+	// Maximum size of a row's data, as configured by Db.MaxValueSize.
+	// Dumping a bigger row fails, since it couldn't be restored.
+	// DefaultMaxValueSize is used if zero.
+	MaxValueSize int
+}
+
+type RestoreOptions struct {
+	// Maximum size of a row's data, as configured by Db.MaxValueSize,
+	// so that a corrupt dump can't allocate more. DefaultMaxValueSize is
+	// used if zero.
+	MaxValueSize int
+}
+
+// Storage transaction whose time can be moved, so that versions written at
+// different times share the transaction. Versions are then written and rows
+// read at the new time.
+type timedStorageTransaction interface {
+	setTime(trxTime time.Time)
+}
+
+func dumpMaxValueSize(maxValueSize int) int {
+	if maxValueSize > 0 {
+		return maxValueSize
+	}
+	return DefaultMaxValueSize
+}
+
+// Writes the rows of every table of the model, index tables included, as a
+// stream of DumpRow messages each prefixed by its length as a varint. The
+// stream doesn't depend on the storage and can be restored into any other.
+func Dump(storage Storage, model *Model, w io.Writer, options DumpOptions) error {
+	trxTime := time.Now()
+	trx, err := storage.GetTransaction(nrv.Token(0), trxTime)
+	if err != nil {
+		return err
+	}
+	defer trx.Rollback()
+
+	maxValueSize := dumpMaxValueSize(options.MaxValueSize)
+	for _, stored := range storedTables(model) {
+		if options.AllVersions {
+			err = dumpTimeline(trx, stored.table, trxTime, w, maxValueSize)
+		} else {
+			err = dumpLatest(trx, stored.table, w, maxValueSize)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func dumpLatest(trx StorageTransaction, table *Table, w io.Writer, maxValueSize int) error {
+	iterator, err := trx.GetQuery(StorageQuery{
+		Table:       table,
+		TablePrefix: []string{},
+	})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for {
+		row, err := iterator.Next()
+		if err != nil {
+			return err
+		} else if row == nil {
+			return nil
+		}
+
+		err = writeDumpRow(w, table, row, maxValueSize)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func dumpTimeline(trx StorageTransaction, table *Table, to time.Time, w io.Writer, maxValueSize int) error {
+	from := time.Unix(0, 0)
+	count := dumpBatchSize
+
+	for {
+		mutations, err := trx.GetTimeline(table, from, count)
+		if err != nil {
+			return err
+		}
+
+		// versions written after the dump's transaction time are left out,
+		// like they are when only dumping latest versions
+		done := false
+		for i, mutation := range mutations {
+			if mutation.NewRow.IntTimestamp > to.UnixNano() {
+				mutations, done = mutations[:i], true
+				break
+			}
+		}
+
+		// versions at the last timestamp may continue in the next batch, so
+		// they are read again from there, unless the batch only has them
+		end := len(mutations)
+		if !done && len(mutations) == count {
+			last := mutations[end-1].NewRow.IntTimestamp
+			for end > 0 && mutations[end-1].NewRow.IntTimestamp == last {
+				end--
+			}
+
+			if end == 0 {
+				count = count * 2
+				continue
+			}
+			from = time.Unix(0, last)
+			count = dumpBatchSize
+		}
+
+		for _, mutation := range mutations[:end] {
+			err = writeDumpRow(w, table, mutation.NewRow, maxValueSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		if done || end == len(mutations) {
+			return nil
+		}
+	}
+}
+
+func writeDumpRow(w io.Writer, table *Table, row *Row, maxValueSize int) error {
+	if len(row.Data) > maxValueSize {
+		return errors.New(fmt.Sprintf("Row %s of table %s has %d bytes of data, over the maximum of %d", row.Keys, table.Path(), len(row.Data), maxValueSize))
+	}
+
+	bytes, err := pb.Marshal(&DumpRow{
+		Table:     pb.String(table.Path()),
+		Keys:      row.Keys,
+		Timestamp: pb.Int64(row.IntTimestamp),
+		Data:      row.Data,
+	})
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, uint64(len(bytes)))
+	_, err = w.Write(header[:n])
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bytes)
+	return err
+}
+
+// Writes rows of a dump into the storage at their original timestamp. The
+// storage needs to be synced with the model first. Rows are written in
+// batches if the storage's transactions can write versions at different
+// times, else consecutive rows having the same timestamp are written in the
+// same transaction.
+func Restore(storage Storage, model *Model, r io.Reader, options RestoreOptions) error {
+	tables := make(map[string]*Table)
+	for _, stored := range storedTables(model) {
+		tables[stored.table.Path()] = stored.table
+	}
+
+	reader := bufio.NewReader(r)
+	maxRowSize := uint64(dumpMaxValueSize(options.MaxValueSize) + dumpRowOverhead)
+
+	var trx StorageTransaction
+	var trxTimestamp int64
+	count := 0
+	for {
+		dumpRow, err := readDumpRow(reader, maxRowSize)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if trx != nil {
+				trx.Rollback()
+			}
+			return err
+		}
+
+		table, found := tables[*dumpRow.Table]
+		if !found {
+			if trx != nil {
+				trx.Rollback()
+			}
+			return errors.New(fmt.Sprintf("Table %s of dump isn't in the model", *dumpRow.Table))
+		} else if len(dumpRow.Keys) != table.Depth() {
+			if trx != nil {
+				trx.Rollback()
+			}
+			return errors.New(fmt.Sprintf("Row of table %s has %d keys, expected %d", *dumpRow.Table, len(dumpRow.Keys), table.Depth()))
+		}
+
+		if trx != nil && trxTimestamp != *dumpRow.Timestamp {
+			if timed, ok := trx.(timedStorageTransaction); ok && count < restoreBatchSize {
+				timed.setTime(time.Unix(0, *dumpRow.Timestamp))
+			} else {
+				err = trx.Commit()
+				if err != nil {
+					return err
+				}
+				trx = nil
+			}
+			trxTimestamp = *dumpRow.Timestamp
+		}
+
+		if trx == nil {
+			trxTimestamp = *dumpRow.Timestamp
+			trx, err = storage.GetTransaction(nrv.Token(0), time.Unix(0, trxTimestamp))
+			if err != nil {
+				return err
+			}
+			count = 0
+		}
+
+		if len(dumpRow.Data) == 0 {
+			err = trx.Delete(table, dumpRow.Keys)
+		} else {
+			err = trx.Set(table, dumpRow.Keys, dumpRow.Data)
+		}
+		if err != nil {
+			trx.Rollback()
+			return err
+		}
+		count++
+	}
+
+	if trx != nil {
+		return trx.Commit()
+	}
+	return nil
+}
+
+func readDumpRow(reader *bufio.Reader, maxRowSize uint64) (*DumpRow, error) {
+	length, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return nil, err
+	} else if length > maxRowSize {
+		return nil, errors.New(fmt.Sprintf("Dump row of %d bytes is over the maximum of %d", length, maxRowSize))
+	}
+
+	bytes := make([]byte, length)
+	_, err = io.ReadFull(reader, bytes)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+
+	dumpRow := &DumpRow{}
+	err = pb.Unmarshal(bytes, dumpRow)
+	if err != nil {
+		return nil, err
+	} else if dumpRow.Table == nil || dumpRow.Timestamp == nil {
+		return nil, errors.New("Dump row is missing its table or timestamp")
+	}
+	return dumpRow, nil
+}
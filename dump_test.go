@@ -0,0 +1,221 @@
+package mry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/appaquet/nrv"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDumpRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	model := newModel()
+	users := model.CreateTable("users")
+	posts := users.CreateSubTable("posts")
+	_, err = posts.CreateIndex("title")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := &MemoryStorage{}
+	source.Init()
+	err = source.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	writes := []struct {
+		time  time.Time
+		table *Table
+		keys  []string
+		data  string
+	}{
+		{now, users, []string{"user1"}, "v1"},
+		{now, users, []string{"user2"}, "v1"},
+		{now.Add(1), users, []string{"user1"}, "v2"},
+		{now.Add(2), users, []string{"user2"}, ""},
+		{now.Add(3), posts, []string{"user1", "post1"}, "post"},
+		{now.Add(time.Hour), users, []string{"user3"}, "future"},
+	}
+	for _, write := range writes {
+		trx, _ := source.GetTransaction(nrv.Token(0), write.time)
+		if write.data == "" {
+			err = trx.Delete(write.table, write.keys)
+		} else {
+			err = trx.Set(write.table, write.keys, []byte(write.data))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		trx.Commit()
+	}
+
+	for i, options := range []DumpOptions{{AllVersions: false}, {AllVersions: true}} {
+		buf := &bytes.Buffer{}
+		err = Dump(source, model, buf, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// restore into another kind of storage, and into one of the same kind
+		dump := buf.Bytes()
+		sqlite := &SqliteStorage{Path: path.Join(dir, "restore"+strconv.Itoa(i)+".db")}
+		for _, dest := range []Storage{sqlite, &MemoryStorage{}} {
+			testRestore(t, dest, model, dump, options, now)
+		}
+	}
+}
+
+func testRestore(t *testing.T, dest Storage, model *Model, dump []byte, options DumpOptions, now time.Time) {
+	users := model.GetTable("users")
+	posts := model.GetTable("users/posts")
+
+	dest.Init()
+	err := dest.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(dest, model, bytes.NewReader(dump), RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := dest.GetTransaction(nrv.Token(0), now.Add(10))
+	row, _ := trx.Get(users, []string{"user1"})
+	if row == nil || string(row.Data) != "v2" || row.IntTimestamp != now.Add(1).UnixNano() {
+		t.Fatalf("Expected latest version of user1 with its timestamp, got %v", row)
+	}
+	if row, _ := trx.Get(users, []string{"user2"}); row != nil {
+		t.Fatalf("Deleted user2 shouldn't be restored, got %v", row)
+	}
+	if row, _ := trx.Get(posts, []string{"user1", "post1"}); row == nil || string(row.Data) != "post" {
+		t.Fatalf("Expected post of sub-table to be restored, got %v", row)
+	}
+
+	history, _ := trx.GetHistory(users, []string{"user1"}, time.Time{}, time.Time{}, 0)
+	if options.AllVersions && len(history) != 2 {
+		t.Fatalf("Expected all versions of user1 to be restored, got %v", history)
+	} else if !options.AllVersions && len(history) != 1 {
+		t.Fatalf("Expected only latest version of user1 to be restored, got %v", history)
+	}
+
+	history, _ = trx.GetHistory(users, []string{"user2"}, time.Time{}, time.Time{}, 0)
+	if options.AllVersions && (len(history) != 2 || !history[0].Deleted()) {
+		t.Fatalf("Expected deletion of user2 to be restored, got %v", history)
+	}
+	trx.Rollback()
+
+	// versions written after the dump started aren't dumped
+	trx, _ = dest.GetTransaction(nrv.Token(0), now.Add(2*time.Hour))
+	if row, _ := trx.Get(users, []string{"user3"}); row != nil {
+		t.Fatalf("Version written after the dump shouldn't be restored, got %v", row)
+	}
+	trx.Rollback()
+}
+
+func TestDumpMaxValueSize(t *testing.T) {
+	model := newModel()
+	users := model.CreateTable("users")
+
+	source := &MemoryStorage{}
+	source.Init()
+	source.SyncModel(model)
+
+	trx, _ := source.GetTransaction(nrv.Token(0), time.Now())
+	trx.Set(users, []string{"user1"}, make([]byte, 2*DefaultMaxValueSize))
+	trx.Commit()
+
+	// rows that couldn't be restored fail the dump
+	buf := &bytes.Buffer{}
+	err := Dump(source, model, buf, DumpOptions{})
+	if err == nil {
+		t.Fatalf("Dumping a row over the maximum value size should fail")
+	}
+
+	buf.Reset()
+	err = Dump(source, model, buf, DumpOptions{MaxValueSize: 3 * DefaultMaxValueSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := &MemoryStorage{}
+	dest.Init()
+	dest.SyncModel(model)
+	err = Restore(dest, model, bytes.NewReader(buf.Bytes()), RestoreOptions{})
+	if err == nil {
+		t.Fatalf("Restoring a row over the maximum value size should fail")
+	}
+	err = Restore(dest, model, bytes.NewReader(buf.Bytes()), RestoreOptions{MaxValueSize: 3 * DefaultMaxValueSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestoreUnknownTable(t *testing.T) {
+	model := newModel()
+	model.CreateTable("users")
+
+	s := &MemoryStorage{}
+	s.Init()
+	s.SyncModel(model)
+
+	other := newModel()
+	other.CreateTable("others")
+
+	buf := &bytes.Buffer{}
+	err := writeDumpRow(buf, other.GetTable("others"), &Row{IntTimestamp: 1, Keys: []string{"key1"}, Data: []byte("data")}, DefaultMaxValueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Restore(s, model, buf, RestoreOptions{})
+	if err == nil {
+		t.Fatalf("Restoring a table that isn't in the model should fail")
+	}
+}
+
+func TestRestoreCorruptDump(t *testing.T) {
+	model := newModel()
+	users := model.CreateTable("users")
+
+	s := &MemoryStorage{}
+	s.Init()
+	s.SyncModel(model)
+
+	// length over the maximum row size
+	header := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(header, 1<<40)
+	err := Restore(s, model, bytes.NewReader(header[:n]), RestoreOptions{})
+	if err == nil {
+		t.Fatalf("Restoring a row over the maximum size should fail")
+	}
+
+	// row having only keys, without table and timestamp
+	err = Restore(s, model, bytes.NewReader([]byte{3, 0x12, 1, 'k'}), RestoreOptions{})
+	if err == nil {
+		t.Fatalf("Restoring a row without table should fail")
+	}
+
+	// row having more keys than its table
+	buf := &bytes.Buffer{}
+	err = writeDumpRow(buf, users, &Row{IntTimestamp: 1, Keys: []string{"key1", "key2"}, Data: []byte("data")}, DefaultMaxValueSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Restore(s, model, buf, RestoreOptions{})
+	if err == nil {
+		t.Fatalf("Restoring a row with the wrong number of keys should fail")
+	}
+}
@@ -13,16 +13,29 @@ type TimelineJobFeeder struct {
 }
 
 func (f *TimelineJobFeeder) Init(context *job.Context) {
-	go func() {
-		var fromTime time.Time = time.Unix(0, 0)
-		if val, ok := context.Config["from_time"]; ok {
-			switch val.(type) {
-			case int64:
-				fromTime = time.Unix(0, val.(int64))
-			case float64:
-				fromTime = time.Unix(0, int64(val.(float64)))
-			}
+	var fromTime time.Time = time.Unix(0, 0)
+	if val, ok := context.Config["from_time"]; ok {
+		switch val.(type) {
+		case int64:
+			fromTime = time.Unix(0, val.(int64))
+		case float64:
+			fromTime = time.Unix(0, int64(val.(float64)))
 		}
+	}
+
+	tableName := context.Config["table"].(string)
+	table := f.Db.GetTable(tableName)
+	if table == nil {
+		nrv.Log.Fatal("Table %s doesn't exist", tableName)
+		return
+	}
+
+	// register position before starting so that compaction keeps
+	// the versions we are about to read
+	f.Db.setFeederPosition(f, table, fromTime)
+
+	go func() {
+		defer f.Db.removeFeeder(f)
 
 		for !f.stopped {
 
@@ -32,13 +45,6 @@ func (f *TimelineJobFeeder) Init(context *job.Context) {
 				nrv.Log.Fatal("Got an error getting transaction in job feeder: %s", err)
 			}
 
-			tableName := context.Config["table"].(string)
-			table := f.Db.GetTable(tableName)
-			if table == nil {
-				nrv.Log.Fatal("Table %s doesn't exist", tableName)
-				return
-			}
-
 			mutations, err := trx.GetTimeline(table, fromTime, 1000)
 			if err != nil {
 				nrv.Log.Fatal("Got an error getting timeline in job feeder: %s", err)
@@ -49,28 +55,15 @@ func (f *TimelineJobFeeder) Init(context *job.Context) {
 			for _, mutation := range mutations {
 				srMutation := &JobRowMutation{}
 
-				newValue := &TransactionValue{}
-				pb.Unmarshal(mutation.NewRow.Data, newValue)
-				srMutation.New = &JobRow{
-					Timestamp: pb.Uint64(uint64(mutation.NewRow.IntTimestamp)),
-					Key1: pb.String(mutation.NewRow.Key1),
-					Key2: pb.String(mutation.NewRow.Key2),
-					Key3: pb.String(mutation.NewRow.Key3),
-					Key4: pb.String(mutation.NewRow.Key4),
-					Data: newValue,
+				srMutation.New = newJobRow(mutation.NewRow)
+
+				// row got deleted, data stays empty
+				if mutation.NewRow.Deleted() {
+					srMutation.New.Deleted = pb.Bool(true)
 				}
 
-				oldValue := &TransactionValue{}
-				if mutation.OldRow.Key1 != "" {
-					pb.Unmarshal(mutation.OldRow.Data, oldValue)
-					srMutation.Old = &JobRow{
-						Timestamp: pb.Uint64(uint64(mutation.OldRow.IntTimestamp)),
-						Key1: pb.String(mutation.OldRow.Key1),
-						Key2: pb.String(mutation.OldRow.Key2),
-						Key3: pb.String(mutation.OldRow.Key3),
-						Key4: pb.String(mutation.OldRow.Key4),
-						Data: oldValue,
-					}
+				if len(mutation.OldRow.Keys) > 0 {
+					srMutation.Old = newJobRow(mutation.OldRow)
 				}
 
 				context.DataChan <- nrv.Map{
@@ -81,6 +74,7 @@ func (f *TimelineJobFeeder) Init(context *job.Context) {
 			}
 
 			trx.Commit()
+			f.Db.setFeederPosition(f, table, fromTime)
 
 			// no row, we wait
 			// TODO: should bind to channel for realtime updates
@@ -94,3 +88,27 @@ func (f *TimelineJobFeeder) Init(context *job.Context) {
 func (f *TimelineJobFeeder) Stop() {
 	f.stopped = true
 }
+
+// Converts a row to a job row. All keys are in Keys, the first four
+// are also copied to Key1..Key4 for consumers that predate it.
+func newJobRow(row *Row) *JobRow {
+	value := &TransactionValue{}
+	value.unmarshallRow(row.Data)
+
+	jobRow := &JobRow{
+		Timestamp: pb.Uint64(uint64(row.IntTimestamp)),
+		Keys: row.Keys,
+		Data: value,
+	}
+
+	legacyKeys := []**string{&jobRow.Key1, &jobRow.Key2, &jobRow.Key3, &jobRow.Key4}
+	for i, legacyKey := range legacyKeys {
+		key := ""
+		if i < len(row.Keys) {
+			key = row.Keys[i]
+		}
+		*legacyKey = pb.String(key)
+	}
+
+	return jobRow
+}
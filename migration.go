@@ -0,0 +1,202 @@
+package mry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type MigrationAction int
+
+const (
+	// Creates a missing table
+	MigrationCreateTable MigrationAction = iota
+
+	// Drops and creates a table whose number of keys changed, losing its data
+	MigrationRecreateTable
+
+	// Drops a table that isn't in the model anymore, losing its data
+	MigrationDropTable
+
+	// Alters a table so that its data column can hold larger values,
+	// keeping its data
+	MigrationAlterTable
+)
+
+// Step of a migration plan, on a table as named in the storage
+type MigrationStep struct {
+	Action   MigrationAction
+	Table    string
+	Depth    int
+	OldDepth int
+
+	// Set if the table stores the entries of an index, which then
+	// needs to be built from the indexed table's rows
+	Index *Index
+}
+
+func (s MigrationStep) Destructive() bool {
+	return s.Action == MigrationRecreateTable || s.Action == MigrationDropTable
+}
+
+func (s MigrationStep) String() string {
+	str := ""
+	switch s.Action {
+	case MigrationCreateTable:
+		str = fmt.Sprintf("CREATE TABLE %s (%d keys)", s.Table, s.Depth)
+	case MigrationRecreateTable:
+		str = fmt.Sprintf("RECREATE TABLE %s (%d keys, was %d), DATA WILL BE LOST", s.Table, s.Depth, s.OldDepth)
+	case MigrationDropTable:
+		str = fmt.Sprintf("DROP TABLE %s, DATA WILL BE LOST", s.Table)
+	case MigrationAlterTable:
+		str = fmt.Sprintf("ALTER TABLE %s to hold large values", s.Table)
+	}
+
+	if s.Index != nil {
+		str = str + fmt.Sprintf(", BUILD INDEX %s ON %s", s.Index.Field, s.Index.table.parentTable.Path())
+	}
+	return str
+}
+
+// Steps needed to bring a storage's schema in line with a model. Steps
+// are only applied explicitly, destructive ones requiring an opt-in.
+type MigrationPlan struct {
+	Steps []MigrationStep
+}
+
+func (p *MigrationPlan) Empty() bool {
+	return len(p.Steps) == 0
+}
+
+func (p *MigrationPlan) Destructive() bool {
+	for _, step := range p.Steps {
+		if step.Destructive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the plan as a dry run, one step per line
+func (p *MigrationPlan) String() string {
+	lines := make([]string, len(p.Steps))
+	for i, step := range p.Steps {
+		lines[i] = step.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns the plan without the steps dropping tables that aren't in the
+// model anymore
+func (p *MigrationPlan) withoutDrops() *MigrationPlan {
+	plan := &MigrationPlan{Steps: make([]MigrationStep, 0)}
+	for _, step := range p.Steps {
+		if step.Action != MigrationDropTable {
+			plan.Steps = append(plan.Steps, step)
+		}
+	}
+	return plan
+}
+
+// Returns an error if the plan has destructive steps that aren't allowed
+func (p *MigrationPlan) check(allowDestructive bool) error {
+	if p.Destructive() && !allowDestructive {
+		return errors.New("Migration plan has destructive steps that need to be explicitly allowed:\n" + p.String())
+	}
+	return nil
+}
+
+// Table of the model as stored, index tables included
+type storedTable struct {
+	table *Table
+	depth int
+	index *Index
+}
+
+// Returns every table of the model that needs to be stored
+func storedTables(model *Model) []storedTable {
+	tables := make([]storedTable, 0)
+
+	var f func(depth int, col *tableCollection)
+	f = func(depth int, col *tableCollection) {
+		for _, table := range col.ToSlice() {
+			tables = append(tables, storedTable{table, depth, nil})
+
+			// index entries have the indexed value as an extra key
+			for _, index := range table.indexes {
+				tables = append(tables, storedTable{index.table, depth + 1, index})
+			}
+
+			f(depth+1, table.subTables)
+		}
+	}
+	f(1, model.tableCollection)
+
+	return tables
+}
+
+// Computes the plan to go from the live tables, given with their number
+// of keys, to the model. Tables are named by the storage.
+func planMigration(model *Model, liveTables map[string]int, name func(table *Table) string) *MigrationPlan {
+	creates := make([]MigrationStep, 0)
+	recreates := make([]MigrationStep, 0)
+	drops := make([]MigrationStep, 0)
+
+	modelTables := make(map[string]bool)
+	for _, stored := range storedTables(model) {
+		tableName := name(stored.table)
+		modelTables[tableName] = true
+
+		liveDepth, found := liveTables[tableName]
+		if !found {
+			creates = append(creates, MigrationStep{Action: MigrationCreateTable, Table: tableName, Depth: stored.depth, Index: stored.index})
+		} else if liveDepth != stored.depth {
+			recreates = append(recreates, MigrationStep{Action: MigrationRecreateTable, Table: tableName, Depth: stored.depth, OldDepth: liveDepth, Index: stored.index})
+		}
+	}
+
+	for tableName, liveDepth := range liveTables {
+		if !modelTables[tableName] {
+			drops = append(drops, MigrationStep{Action: MigrationDropTable, Table: tableName, OldDepth: liveDepth})
+		}
+	}
+
+	plan := &MigrationPlan{Steps: make([]MigrationStep, 0)}
+	for _, steps := range [][]MigrationStep{creates, recreates, drops} {
+		sort.Sort(migrationStepsByTable(steps))
+		plan.Steps = append(plan.Steps, steps...)
+	}
+	return plan
+}
+
+// Storage that can migrate its schema
+type migrator interface {
+	PlanMigration(model *Model) (*MigrationPlan, error)
+	ApplyMigration(plan *MigrationPlan, allowDestructive bool) error
+}
+
+// Creates missing tables of the model, applies non-destructive alters (ex:
+// widening data columns) and returns the applied plan. Tables that aren't in
+// the model anymore are left untouched, but it fails if tables need to be
+// recreated.
+func syncModel(storage migrator, model *Model) (*MigrationPlan, error) {
+	plan, err := storage.PlanMigration(model)
+	if err != nil {
+		return nil, err
+	}
+
+	err = plan.withoutDrops().check(false)
+	if err != nil {
+		return nil, err
+	}
+
+	plan = plan.withoutDrops()
+	return plan, storage.ApplyMigration(plan, false)
+}
+
+type migrationStepsByTable []MigrationStep
+
+func (s migrationStepsByTable) Len() int           { return len(s) }
+func (s migrationStepsByTable) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s migrationStepsByTable) Less(i, j int) bool { return s[i].Table < s[j].Table }
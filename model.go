@@ -1,7 +1,12 @@
 package mry
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"strings"
+	"time"
 )
 
 // Database model
@@ -17,8 +22,12 @@ func newModel() *Model {
 // Structure that represents a table in the storage
 type Table struct {
 	Name        string
+	Retention   RetentionPolicy
 
-	indexes     []Index
+	// Time to live of rows set without one, rows not expiring if zero
+	TTL         time.Duration
+
+	indexes     []*Index
 	parentTable *Table
 	subTables   *tableCollection
 }
@@ -26,7 +35,7 @@ type Table struct {
 func newTable(name string) *Table {
 	t := &Table{
 		Name: name,
-		indexes: make([]Index, 0),
+		indexes: make([]*Index, 0),
 	}
 	t.subTables = newTableCollection(t)
 	return t
@@ -44,6 +53,56 @@ func (t *Table) SubTables() []*Table {
 	return t.subTables.ToSlice()
 }
 
+// Creates an index on a field of the table's rows. Entries are stored in
+// a table under this one, keyed by the field value and the row key. Top
+// level tables can't be indexed, since their rows are spread by token and
+// can't be looked up.
+func (t *Table) CreateIndex(field string) (*Index, error) {
+	if t.parentTable == nil {
+		return nil, errors.New(fmt.Sprintf("Cannot index top level table %s", t.Name))
+	}
+
+	if index := t.GetIndex(field); index != nil {
+		return index, nil
+	}
+
+	index := &Index{
+		Field: field,
+		table: &Table{
+			Name:        "_idx_" + field,
+			parentTable: t,
+			indexes:     make([]*Index, 0),
+			subTables:   newTableCollection(nil),
+		},
+	}
+	t.indexes = append(t.indexes, index)
+
+	return index, nil
+}
+
+func (t *Table) GetIndex(field string) *Index {
+	for _, index := range t.indexes {
+		if index.Field == field {
+			return index
+		}
+	}
+	return nil
+}
+
+func (t *Table) Indexes() []*Index {
+	return t.indexes
+}
+
+// Returns the full path of the table from the root of the model
+// (ex: "posts/comments"), as accepted by GetTable
+func (t *Table) Path() string {
+	if t.parentTable == nil {
+		return t.Name
+	}
+
+	return t.parentTable.Path() + "/" + t.Name
+}
+
 func (t *Table) Depth() int {
 	if t.parentTable == nil {
 		return 1
@@ -52,9 +111,105 @@ func (t *Table) Depth() int {
 	return t.parentTable.Depth() + 1
 }
 
+// Retention policy of the versions of a table's rows, used by compaction.
+// Zero values keep versions forever.
+type RetentionPolicy struct {
+	// Maximum number of versions kept per row
+	MaxVersions int
+
+	// Maximum age of the versions kept
+	MaxAge time.Duration
+}
+
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxVersions > 0 || p.MaxAge > 0
+}
+
+// Returns how many of the oldest versions of a row, given by their timestamps
+// in ascending order, can be removed. The latest version is always kept, as
+// well as versions at or after the horizon and the last version before it,
+// which is the old row of the first mutation after the horizon.
+func (p RetentionPolicy) prunableVersions(timestamps []int64, now time.Time, horizon time.Time) int {
+	count := 0
+	if p.MaxVersions > 0 && len(timestamps) > p.MaxVersions {
+		count = len(timestamps) - p.MaxVersions
+	}
+
+	if p.MaxAge > 0 {
+		limit := now.Add(-p.MaxAge).UnixNano()
+		for count < len(timestamps) && timestamps[count] < limit {
+			count++
+		}
+	}
+
+	// keep the last version before the horizon, and the latest one
+	beforeHorizon := 0
+	for beforeHorizon < len(timestamps) && timestamps[beforeHorizon] < horizon.UnixNano() {
+		beforeHorizon++
+	}
+	if count > beforeHorizon-1 {
+		count = beforeHorizon - 1
+	}
+	if count > len(timestamps)-1 {
+		count = len(timestamps) - 1
+	}
+	if count < 0 {
+		count = 0
+	}
+
+	return count
+}
+
 // Index on a field of table
 type Index struct {
 	Field string
+
+	table *Table
+}
+
+// Returns the table in which the index entries are stored
+func (i *Index) Table() *Table {
+	return i.table
+}
+
+// Returns the keys of the entry of a row having the given field value,
+// made of the row prefix, the indexed value and the row key
+func (i *Index) entryKeys(rowKeys []string, value interface{}) []string {
+	keys := append([]string{}, rowKeys[:len(rowKeys)-1]...)
+	return append(keys, indexValueKey(value), rowKeys[len(rowKeys)-1])
+}
+
+// Maximum length of the key of an indexed value, keys being limited to 128
+// characters by some storages
+const maxIndexValueKeyLength = 128
+
+// Returns the key of an indexed value, which is its typed value or a hash
+// of it when too long to be a key. Values sharing a hash also share their
+// entry, so rows need to be checked when looked up.
+func indexValueKey(value interface{}) string {
+	key := indexTypedValue(value)
+	if len(key) > maxIndexValueKeyLength {
+		hash := sha256.Sum256([]byte(key))
+		return "h:" + hex.EncodeToString(hash[:])
+	}
+	return key
+}
+
+// Returns the value prefixed by its type so that values of different types
+// printed alike, such as 5 and "5", don't share entries. Numbers share their
+// prefix, whatever their type.
+func indexTypedValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "s:" + v
+	case bool:
+		return "b:" + fmt.Sprint(v)
+	case []byte:
+		return "x:" + hex.EncodeToString(v)
+	case int, int32, int64, uint32, uint64, float32, float64:
+		return "n:" + fmt.Sprint(v)
+	}
+	return "v:" + fmt.Sprint(value)
 }
 
 // Colection of tables
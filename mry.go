@@ -2,10 +2,17 @@ package mry
 
 import (
 	pb "code.google.com/p/goprotobuf/proto"
+	"errors"
 	"github.com/appaquet/nrv"
+	"io"
+	"sync"
 	"time"
 )
 
+// Maximum size of a row's data used when Db.MaxValueSize isn't set, within
+// the 4MB max_allowed_packet that MySQL servers default to
+const DefaultMaxValueSize = 4*1024*1024 - 64*1024
+
 //
 // Database object bound to a specific domain of a given cluster
 //
@@ -17,6 +24,34 @@ type Db struct {
 	Cluster     nrv.Cluster
 	Storage     Storage
 	Service     *nrv.Service
+
+	// Codec encoding the data of written rows, rows being written as is if
+	// nil. Rows stay readable whatever codec they were written with.
+	Codec Codec
+
+	// Maximum size of a row's data once marshalled, encoded and stored,
+	// bigger values failing the transaction. DefaultMaxValueSize is used if
+	// zero.
+	MaxValueSize int
+
+	feedersMutex sync.Mutex
+	feeders      map[*TimelineJobFeeder]feederPosition
+
+	compactionMutex sync.Mutex
+	compactionStop  chan bool
+
+	expiryMutex sync.Mutex
+	expiryStop  chan bool
+
+	// tables to sweep for expired rows, every table if nil
+	expiringMutex  sync.Mutex
+	expiringTables map[*Table]bool
+}
+
+// Position of a timeline feeder in a table's timeline
+type feederPosition struct {
+	table *Table
+	time  time.Time
 }
 
 func (db *Db) SetupCluster() {
@@ -50,88 +85,529 @@ func (db *Db) SetupCluster() {
 	db.Storage.Init()
 }
 
-// TODO: rollback on panic
 func (db *Db) NrvExecute(request *nrv.ReceivedRequest) {
 	logger := nrv.Logger(request.Logger)
 	trace := logger.Trace("mry")
 	iTrx := request.Message.Data["t"]
 
 	if trx, ok := iTrx.(*Transaction); ok {
-		logger.Debug("Executing transaction %d %s", *trx.Id)
+		ret := db.executeTransaction(trx, logger)
+		trace.End()
+
+		request.Reply(nrv.Map{
+			"t": &Transaction{
+				Id:     trx.Id,
+				Return: ret,
+			},
+		})
+	} else {
+		logger.Error("Received a null transaction")
+
+	}
+}
+
+// Executes a transaction on the storage, first in dry mode to discover its
+// token, then for real. The storage transaction is committed only if no
+// error occurred.
+// TODO: rollback on panic
+func (db *Db) executeTransaction(trx *Transaction, logger nrv.Logger) *TransactionReturn {
+	logger.Debug("Executing transaction %d", *trx.Id)
+
+	// dry execution to discover token and some errors
+	traceDry := logger.Trace("execute_dry")
+
+	context := &transactionContext{
+		dry:        true,
+		db:         db,
+		trx:        trx,
+		logger:     logger,
+		storageTrx: nil,
+	}
+	context.init()
+
+	db.executeLocal(context)
+	if context.token == nil {
+		context.token = context.conditionalToken
+	}
+	if context.token == nil && context.ret.Error == nil {
+		context.setError("Couldn't find token for transaction")
+	}
+	traceDry.End()
+
+	if context.ret.Error != nil {
+		logger.Debug("Error executing transaction in dry mode: %s", context.ret.Error)
+		return context.ret
+	}
+
+	logger.Debug("Transaction has token %d", *context.token)
+
+	traceReal := logger.Trace("execute_real")
+	defer traceReal.End()
+
+	context = &transactionContext{
+		dry:        false,
+		db:         db,
+		trx:        trx,
+		logger:     logger,
+		token:      context.token,
+		storageTrx: nil,
+	}
+	context.init()
+
+	db.executeLocal(context)
+	if context.ret.Error == nil {
+		err := context.storageTrx.Commit()
+		if err != nil {
+			context.setError("Couldn't commit transaction: %s", err)
+		}
+	} else {
+		if context.storageTrx != nil {
+			context.storageTrx.Rollback()
+		}
+		logger.Debug("Error executing transaction: %s", context.ret.Error)
+	}
+
+	return context.ret
+}
+
+// Storage adding bytes to the data of the rows it stores
+type dataOverheader interface {
+	dataOverhead() int
+}
+
+// Returns the maximum size of encoded values, the storage adding its own
+// bytes once the size is checked
+func (db *Db) maxValueSize() int {
+	size := DefaultMaxValueSize
+	if db.MaxValueSize > 0 {
+		size = db.MaxValueSize
+	}
+
+	if storage, ok := db.Storage.(dataOverheader); ok {
+		size -= storage.dataOverhead()
+	}
+	return size
+}
+
+func (db *Db) setFeederPosition(feeder *TimelineJobFeeder, table *Table, position time.Time) {
+	db.feedersMutex.Lock()
+	defer db.feedersMutex.Unlock()
+
+	if db.feeders == nil {
+		db.feeders = make(map[*TimelineJobFeeder]feederPosition)
+	}
+	db.feeders[feeder] = feederPosition{table, position}
+}
+
+func (db *Db) removeFeeder(feeder *TimelineJobFeeder) {
+	db.feedersMutex.Lock()
+	defer db.feedersMutex.Unlock()
+
+	delete(db.feeders, feeder)
+}
 
-		// dry execution to discover token and some errors
-		traceDry := logger.Trace("execute_dry")
+// Returns the time from which the timeline of the table is still needed
+// by running feeders
+func (db *Db) compactionHorizon(table *Table, now time.Time) time.Time {
+	db.feedersMutex.Lock()
+	defer db.feedersMutex.Unlock()
 
-		context := &transactionContext{
-			dry:        true,
-			db:         db,
-			trx:        trx,
-			logger:     logger,
-			storageTrx: nil,
+	horizon := now
+	for _, position := range db.feeders {
+		if position.table == table && position.time.Before(horizon) {
+			horizon = position.time
 		}
-		context.init()
+	}
+	return horizon
+}
+
+// Removes versions of rows that are out of their table's retention policy
+func (db *Db) Compact() error {
+	now := time.Now()
 
-		db.executeLocal(context)
-		if context.token == nil && context.ret.Error == nil {
-			context.setError("Couldn't find token for transaction")
+	var f func(tables []*Table) error
+	f = func(tables []*Table) error {
+		for _, table := range tables {
+			if table.Retention.Enabled() {
+				err := db.Storage.Compact(table, now, db.compactionHorizon(table, now))
+				if err != nil {
+					return err
+				}
+			}
+
+			err := f(table.SubTables())
+			if err != nil {
+				return err
+			}
 		}
-		traceDry.End()
+		return nil
+	}
 
-		// continue if no error
-		if context.ret.Error == nil {
-			logger.Debug("Transaction has token %d", *context.token)
+	return f(db.ToSlice())
+}
+
+// Starts compacting the storage in background at the given interval
+func (db *Db) StartCompaction(interval time.Duration) {
+	db.compactionMutex.Lock()
+	defer db.compactionMutex.Unlock()
+
+	db.stopCompaction()
+
+	stop := make(chan bool)
+	db.compactionStop = stop
 
-			traceReal := logger.Trace("execute_real")
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-			context = &transactionContext{
-				dry:        false,
-				db:         db,
-				trx:        trx,
-				logger:     logger,
-				token:      context.token,
-				storageTrx: nil,
+		for {
+			select {
+			case <-ticker.C:
+				err := db.Compact()
+				if err != nil {
+					nrv.Log.Error("Got an error compacting storage: %s", err)
+				}
+			case <-stop:
+				return
 			}
-			context.init()
+		}
+	}()
+}
+
+func (db *Db) StopCompaction() {
+	db.compactionMutex.Lock()
+	defer db.compactionMutex.Unlock()
+
+	db.stopCompaction()
+}
+
+// Stops the background compaction, if any. Compaction mutex must be held.
+func (db *Db) stopCompaction() {
+	if db.compactionStop != nil {
+		close(db.compactionStop)
+		db.compactionStop = nil
+	}
+}
 
-			db.executeLocal(context)
-			if context.ret.Error == nil {
-				err := context.storageTrx.Commit()
+// Deletes rows that expired, so that they get out of indexes and that
+// timeline consumers see their expiry. Only tables having a time to live or
+// rows set with one since the last sweep are swept, every table being swept
+// the first time since rows may have been written by another process.
+func (db *Db) Expire() error {
+	now := time.Now()
+
+	db.expiringMutex.Lock()
+	marked := db.expiringTables
+	db.expiringTables = make(map[*Table]bool)
+	db.expiringMutex.Unlock()
+
+	var f func(tables []*Table) error
+	f = func(tables []*Table) error {
+		for _, table := range tables {
+			if marked == nil || table.TTL > 0 || marked[table] {
+				pending, err := db.expireTable(table, now)
 				if err != nil {
-					context.setError("Couldn't commit transaction: %s", err)
+					return err
+				} else if pending {
+					db.markExpiring(table)
 				}
-			} else {
-				logger.Debug("Error executing transaction: %s", context.ret.Error)
 			}
-			traceReal.End()
-		} else {
-			if context.storageTrx != nil {
-				context.storageTrx.Rollback()
+
+			err := f(table.SubTables())
+			if err != nil {
+				return err
 			}
-			logger.Debug("Error executing transaction in dry mode: %s", context.ret.Error)
 		}
-		trace.End()
+		return nil
+	}
 
-		request.Reply(nrv.Map{
-			"t": &Transaction{
-				Id:     trx.Id,
-				Return: context.ret,
-			},
-		})
-	} else {
-		logger.Error("Received a null transaction")
+	err := f(db.ToSlice())
+	if err != nil {
+		// tables that didn't get swept are swept next time
+		db.expiringMutex.Lock()
+		db.expiringTables = nil
+		db.expiringMutex.Unlock()
+	}
+	return err
+}
 
+// Marks the table as having rows with a time to live, to be swept
+func (db *Db) markExpiring(table *Table) {
+	db.expiringMutex.Lock()
+	defer db.expiringMutex.Unlock()
+
+	if db.expiringTables != nil {
+		db.expiringTables[table] = true
 	}
 }
 
+// Deletes rows of the table that expired at the given time. Returns true if
+// rows will expire later.
+func (db *Db) expireTable(table *Table, now time.Time) (pending bool, err error) {
+	expired, pending, err := db.expiredRows(table, now)
+	if err != nil || len(expired) == 0 {
+		return pending, err
+	}
+
+	// rows are read again by the deleting transaction, since they may have
+	// been set again since
+	trx, err := db.Storage.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		return pending, err
+	}
+
+	for _, keys := range expired {
+		row, err := trx.Get(table, keys)
+		if err != nil {
+			trx.Rollback()
+			return pending, err
+		} else if row == nil {
+			continue
+		}
+
+		trxVal := &TransactionValue{}
+		err = trxVal.unmarshallRow(row.Data)
+		if err != nil {
+			trx.Rollback()
+			return pending, err
+		}
+
+		if !valueExpired(trxVal, now) {
+			if _, found := valueExpiry(trxVal); found {
+				pending = true
+			}
+			continue
+		}
+
+		err = trx.Delete(table, keys)
+		if err != nil {
+			trx.Rollback()
+			return pending, err
+		}
+
+		value, _ := trxVal.ToInterface().(nrv.Map)
+		for _, index := range table.Indexes() {
+			if field, found := value[index.Field]; found {
+				err = trx.Delete(index.table, index.entryKeys(keys, field))
+				if err != nil {
+					trx.Rollback()
+					return pending, err
+				}
+			}
+		}
+	}
+
+	return pending, trx.Commit()
+}
+
+// Returns the keys of the table's rows that expired at the given time, and
+// whether rows will expire later
+func (db *Db) expiredRows(table *Table, now time.Time) (expired [][]string, pending bool, err error) {
+	trx, err := db.Storage.GetTransaction(nrv.Token(0), now)
+	if err != nil {
+		return nil, false, err
+	}
+	defer trx.Rollback()
+
+	iterator, err := trx.GetQuery(StorageQuery{
+		Table:       table,
+		TablePrefix: []string{},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer iterator.Close()
+
+	for {
+		row, err := iterator.Next()
+		if err != nil {
+			return nil, false, err
+		} else if row == nil {
+			break
+		}
+
+		trxVal := &TransactionValue{}
+		err = trxVal.unmarshallRow(row.Data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if valueExpired(trxVal, now) {
+			expired = append(expired, append([]string{}, row.Keys...))
+		} else if _, found := valueExpiry(trxVal); found {
+			pending = true
+		}
+	}
+
+	return expired, pending, nil
+}
+
+// Starts deleting expired rows in background at the given interval
+func (db *Db) StartExpiry(interval time.Duration) {
+	db.expiryMutex.Lock()
+	defer db.expiryMutex.Unlock()
+
+	db.stopExpiry()
+
+	stop := make(chan bool)
+	db.expiryStop = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := db.Expire()
+				if err != nil {
+					nrv.Log.Error("Got an error expiring rows: %s", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (db *Db) StopExpiry() {
+	db.expiryMutex.Lock()
+	defer db.expiryMutex.Unlock()
+
+	db.stopExpiry()
+}
+
+// Stops the background expiry, if any. Expiry mutex must be held.
+func (db *Db) stopExpiry() {
+	if db.expiryStop != nil {
+		close(db.expiryStop)
+		db.expiryStop = nil
+	}
+}
+
+// Creates missing tables of the model, applies non-destructive alters and
+// builds new indexes. Fails if the schema needs destructive changes, which
+// need an explicit migration.
 func (db *Db) SyncModel() error {
-	return db.Storage.SyncModel(db.Model)
+	plan, err := syncModel(db.Storage, db.Model)
+	if err != nil {
+		return err
+	}
+
+	return db.buildIndexes(plan)
+}
+
+// Returns the migration plan of the storage to the model, which can be
+// printed as a dry run
+func (db *Db) PlanMigration() (*MigrationPlan, error) {
+	return db.Storage.PlanMigration(db.Model)
+}
+
+// Applies a migration plan and builds indexes whose tables got created
+func (db *Db) ApplyMigration(plan *MigrationPlan, allowDestructive bool) error {
+	err := db.Storage.ApplyMigration(plan, allowDestructive)
+	if err != nil {
+		return err
+	}
+
+	return db.buildIndexes(plan)
+}
+
+func (db *Db) buildIndexes(plan *MigrationPlan) error {
+	for _, step := range plan.Steps {
+		if step.Index != nil && step.Action != MigrationDropTable {
+			err := db.buildIndex(step.Index)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Adds an entry to the index for every row of the indexed table
+func (db *Db) buildIndex(index *Index) error {
+	table := index.table.parentTable
+
+	trx, err := db.Storage.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		return err
+	}
+
+	iterator, err := trx.GetQuery(StorageQuery{
+		Table:       table,
+		TablePrefix: []string{},
+	})
+	if err != nil {
+		trx.Rollback()
+		return err
+	}
+
+	// collect entries first, the storage may not allow a set while iterating
+	entries := make([][]string, 0)
+	for {
+		row, err := iterator.Next()
+		if err != nil {
+			iterator.Close()
+			trx.Rollback()
+			return err
+		} else if row == nil {
+			break
+		}
+
+		trxVal := &TransactionValue{}
+		err = trxVal.unmarshallRow(row.Data)
+		if err != nil {
+			iterator.Close()
+			trx.Rollback()
+			return err
+		}
+
+		if value, ok := trxVal.ToInterface().(nrv.Map); ok {
+			if field, found := value[index.Field]; found {
+				entries = append(entries, index.entryKeys(row.Keys, field))
+			}
+		}
+	}
+	iterator.Close()
+
+	for _, keys := range entries {
+		err = trx.Set(index.table, keys, []byte{1})
+		if err != nil {
+			trx.Rollback()
+			return err
+		}
+	}
+
+	return trx.Commit()
+}
+
+// Writes the rows of the model's tables to w, see Dump. Rows are limited
+// to the maximum value size of the Db if the options don't set one.
+func (db *Db) Dump(w io.Writer, options DumpOptions) error {
+	if options.MaxValueSize == 0 {
+		options.MaxValueSize = db.MaxValueSize
+	}
+	return Dump(db.Storage, db.Model, w, options)
+}
+
+// Restores rows dumped by Dump, the model needing to be synced first
+func (db *Db) Restore(r io.Reader) error {
+	err := Restore(db.Storage, db.Model, r, RestoreOptions{MaxValueSize: db.MaxValueSize})
+
+	// restored rows may have a time to live
+	db.expiringMutex.Lock()
+	db.expiringTables = nil
+	db.expiringMutex.Unlock()
+
+	return err
 }
 
 func (db *Db) NewTransaction(cb func(b Block)) *Transaction {
 	trx := &Transaction{
 		Id: pb.Uint64(uint64(time.Now().UnixNano())), // TODO: put real id from nrv		
 	}
-	cb(trx.newBlock())
+	cb(newBlockBuilder(trx))
 	return trx
 }
 
@@ -139,6 +615,11 @@ func (db *Db) Execute(cb func(b Block)) *TransactionReturn {
 	return db.ExecuteTrx(db.NewTransaction(cb))
 }
 
+// Executes a read-only transaction on rows as they were at the given time
+func (db *Db) ExecuteAsOf(readTime time.Time, cb func(b Block)) *TransactionReturn {
+	return db.ExecuteTrx(db.NewTransaction(cb).AsOf(readTime))
+}
+
 func (db *Db) ExecuteLog(cb func(b Block), logger nrv.Logger) *TransactionReturn {
 	return db.ExecuteTrxLog(db.NewTransaction(cb), logger)
 }
@@ -160,9 +641,51 @@ func (db *Db) ExecuteTrxLog(t Transactable, logger nrv.Logger) *TransactionRetur
 	return resp.Message.Data["t"].(*Transaction).Return
 }
 
+// Streams the rows of the variable returned by query by paging on the
+// client side: each chunk of chunkSize rows is a GetPage of its own
+// read-only transaction, so that neither side holds more than a chunk in
+// memory. Every chunk reads rows as they were when the stream started.
+// Stops at the first error returned by cb.
+func (db *Db) Stream(query func(b Block) BlockVariable, chunkSize int, cb func(row interface{}) error) error {
+	return db.stream(db.ExecuteTrx, query, chunkSize, cb)
+}
+
+func (db *Db) stream(execute func(t Transactable) *TransactionReturn, query func(b Block) BlockVariable, chunkSize int, cb func(row interface{}) error) error {
+	if chunkSize <= 0 {
+		return errors.New("Chunk size must be positive")
+	}
+
+	readTime := time.Now()
+	var cursor interface{}
+	for {
+		ret := execute(db.NewTransaction(func(b Block) {
+			rows, next := query(b).GetPage(chunkSize, cursor)
+			b.Return(rows, next)
+		}).AsOf(readTime))
+		if ret.Error != nil {
+			return errors.New(*ret.Error.Message)
+		}
+
+		vals := ret.GetAll()
+		if rows, ok := vals[0].(nrv.Array); ok {
+			for _, row := range rows {
+				err := cb(row)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		cursor = vals[1]
+		if cursor == nil {
+			return nil
+		}
+	}
+}
+
 func (db *Db) executeLocal(context *transactionContext) {
 	if !context.dry {
-		trxTime := time.Unix(0, int64(*context.trx.Id))
+		trxTime := context.trx.readTime()
 		trc := context.logger.Trace("gettrx")
 		storageTrx, err := context.db.Storage.GetTransaction(*context.token, trxTime)
 		if err != nil {
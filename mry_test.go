@@ -1 +1,1002 @@
 package mry
+
+import (
+	pb "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a database on a memory storage, without any cluster
+func newTestDb(t *testing.T) *Db {
+	db := &Db{
+		Model:   newModel(),
+		Storage: &MemoryStorage{},
+	}
+	db.Storage.Init()
+	return db
+}
+
+// Executes the transaction directly on the database, like the "/execute"
+// endpoint would
+func executeTestTrx(t *testing.T, db *Db, cb func(b Block)) *TransactionReturn {
+	ret := db.executeTransaction(db.NewTransaction(cb), &nrv.RequestLogger{})
+	if ret.Error != nil {
+		t.Fatalf("Transaction failed: %s", *ret.Error.Message)
+	}
+	return ret
+}
+
+func TestTransactionDelete(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("users")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": "user1"})
+	})
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Return()
+	})
+	if vals := ret.GetAll(); len(vals) != 1 || vals[0] == nil {
+		t.Fatalf("Row should exist before delete: %v", vals)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Delete("user1")
+	})
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Return()
+	})
+	if vals := ret.GetAll(); len(vals) != 1 || vals[0] != nil {
+		t.Fatalf("Row should be deleted: %v", vals)
+	}
+}
+
+func TestCompactionHorizon(t *testing.T) {
+	db := newTestDb(t)
+	table := db.CreateTable("users")
+	other := db.CreateTable("others")
+
+	now := time.Now()
+	if horizon := db.compactionHorizon(table, now); horizon != now {
+		t.Fatalf("Horizon should be now without feeder, got %s", horizon)
+	}
+
+	feeder := &TimelineJobFeeder{Db: db}
+	db.setFeederPosition(feeder, table, now.Add(-10))
+	db.setFeederPosition(&TimelineJobFeeder{Db: db}, other, now.Add(-20))
+
+	if horizon := db.compactionHorizon(table, now); horizon != now.Add(-10) {
+		t.Fatalf("Horizon should be the feeder's position, got %s", horizon)
+	}
+
+	db.removeFeeder(feeder)
+	if horizon := db.compactionHorizon(table, now); horizon != now {
+		t.Fatalf("Horizon should be now once feeder is removed, got %s", horizon)
+	}
+}
+
+func TestTransactionRowKeys(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("users").CreateSubTable("posts")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Set("post1", nrv.Map{"title": "post1"})
+	})
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Get("post1").Return()
+	})
+
+	vals := ret.GetAll()
+	if len(vals) != 1 {
+		t.Fatalf("Expected 1 returned value, got %v", vals)
+	}
+
+	post, ok := vals[0].(nrv.Map)
+	if !ok || post["_key1"] != "user1" || post["_key2"] != "post1" || post["title"] != "post1" {
+		t.Fatalf("Row should have its keys as metadata: %v", vals[0])
+	}
+	if _, found := post["_key3"]; found {
+		t.Fatalf("Row shouldn't have more keys than its depth: %v", post)
+	}
+}
+
+func TestTransactionLookup(t *testing.T) {
+	db := newTestDb(t)
+	posts := db.CreateTable("users").CreateSubTable("posts")
+	index, err := posts.CreateIndex("tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// indexes stay the same as others get created
+	for i := 0; i < 8; i++ {
+		posts.CreateIndex("field" + strconv.Itoa(i))
+	}
+	if posts.GetIndex("tag") != index {
+		t.Fatalf("Index should stay the same once created")
+	}
+
+	// top level rows are spread by token, and can't be looked up
+	_, err = db.CreateTable("users").CreateIndex("name")
+	if err == nil {
+		t.Fatalf("Index on a top level table should fail")
+	}
+
+	err = db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		userPosts := b.From("users").Get("user1").Rel("posts")
+		userPosts.Set("post1", nrv.Map{"tag": "go"})
+		userPosts.Set("post2", nrv.Map{"tag": "go"})
+		userPosts.Set("post3", nrv.Map{"tag": "rust"})
+		userPosts.Set("post4", nrv.Map{"tag": int64(5)})
+		userPosts.Set("post5", nrv.Map{"tag": "5"})
+	})
+
+	lookup := func(tag interface{}) nrv.Array {
+		ret := executeTestTrx(t, db, func(b Block) {
+			b.From("users").Get("user1").Rel("posts").Lookup("tag", tag).Return()
+		})
+		return ret.GetAll()[0].(nrv.Array)
+	}
+
+	if rows := lookup("go"); len(rows) != 2 {
+		t.Fatalf("Expected 2 rows tagged go, got %v", rows)
+	}
+
+	// values of different types don't share entries, rows having their keys
+	if rows := lookup(5); len(rows) != 1 || rows[0].(nrv.Map)["_key2"] != "post4" {
+		t.Fatalf("Expected only the row tagged with the number 5, got %v", rows)
+	}
+	if rows := lookup("5"); len(rows) != 1 || rows[0].(nrv.Map)["_key2"] != "post5" {
+		t.Fatalf("Expected only the row tagged with the string 5, got %v", rows)
+	}
+
+	// index follows updates and deletions
+	executeTestTrx(t, db, func(b Block) {
+		userPosts := b.From("users").Get("user1").Rel("posts")
+		userPosts.Set("post1", nrv.Map{"tag": "rust"})
+		userPosts.Delete("post2")
+	})
+
+	if rows := lookup("go"); len(rows) != 0 {
+		t.Fatalf("Expected no row tagged go, got %v", rows)
+	}
+	if rows := lookup("rust"); len(rows) != 2 {
+		t.Fatalf("Expected 2 rows tagged rust, got %v", rows)
+	}
+
+	// long values are hashed to fit in the keys of entries
+	long := strings.Repeat("a", 300)
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Set("post6", nrv.Map{"tag": long})
+	})
+	if rows := lookup(long); len(rows) != 1 || rows[0].(nrv.Map)["_key2"] != "post6" {
+		t.Fatalf("Expected only the row tagged with the long value, got %v", rows)
+	}
+	if rows := lookup(long + "b"); len(rows) != 0 {
+		t.Fatalf("Expected no row tagged with another long value, got %v", rows)
+	}
+	if key := indexValueKey(long); len(key) > maxIndexValueKeyLength {
+		t.Fatalf("Expected key of long value to fit in a key, got %d characters", len(key))
+	}
+
+	// changing the type of a value printed alike moves its entry
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Set("post5", nrv.Map{"tag": int64(5)})
+	})
+
+	if rows := lookup("5"); len(rows) != 0 {
+		t.Fatalf("Expected no row tagged with the string 5, got %v", rows)
+	}
+	if rows := lookup(5); len(rows) != 2 {
+		t.Fatalf("Expected 2 rows tagged with the number 5, got %v", rows)
+	}
+
+	ret := db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Lookup("title", "post1").Return()
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Lookup on a field without index should fail")
+	}
+}
+
+func TestMigrationBuildsIndex(t *testing.T) {
+	db := newTestDb(t)
+	posts := db.CreateTable("users").CreateSubTable("posts")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		userPosts := b.From("users").Get("user1").Rel("posts")
+		userPosts.Set("post1", nrv.Map{"tag": "go"})
+		userPosts.Set("post2", nrv.Map{"tag": "rust"})
+	})
+
+	_, err = posts.CreateIndex("tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := db.PlanMigration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 1 || plan.Steps[0].Index == nil {
+		t.Fatalf("Expected a step building the index, got:\n%s", plan)
+	}
+
+	err = db.ApplyMigration(plan, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("user1").Rel("posts").Lookup("tag", "go").Return()
+	})
+	if rows := ret.GetAll()[0].(nrv.Array); len(rows) != 1 {
+		t.Fatalf("Existing rows should have been indexed, got %v", rows)
+	}
+}
+
+func TestTransactionQuery(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("posts").CreateSubTable("comments")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post1").Rel("comments")
+		for i := 1; i <= 5; i++ {
+			comments.Set("comment"+strconv.Itoa(i), nrv.Map{"id": int64(i)})
+		}
+	})
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.From("posts").Get("post1").Rel("comments").Query(QueryOptions{Reverse: true, Limit: 2}).GetAll().Return()
+	})
+
+	rows := ret.GetAll()[0].(nrv.Array)
+	if len(rows) != 2 || rows[0].(nrv.Map)["id"] != int64(5) || rows[1].(nrv.Map)["id"] != int64(4) {
+		t.Fatalf("Expected the last 2 comments, got %v", rows)
+	}
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		b.From("posts").Get("post1").Rel("comments").Query(QueryOptions{StartKey: "comment2", EndKey: "comment4", EndExclusive: true}).GetAll().Return()
+	})
+
+	rows = ret.GetAll()[0].(nrv.Array)
+	if len(rows) != 2 || rows[0].(nrv.Map)["id"] != int64(2) || rows[1].(nrv.Map)["id"] != int64(3) {
+		t.Fatalf("Expected comments between comment2 and comment4, got %v", rows)
+	}
+}
+
+func TestTransactionGetPage(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("posts").CreateSubTable("comments")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post1").Rel("comments")
+		for i := 1; i <= 5; i++ {
+			comments.Set("comment"+strconv.Itoa(i), nrv.Map{"id": int64(i)})
+		}
+	})
+
+	ids := make([]int64, 0)
+	var cursor interface{}
+	for pages := 0; pages == 0 || cursor != nil; pages++ {
+		if pages > 3 {
+			t.Fatalf("Too many pages")
+		}
+
+		ret := executeTestTrx(t, db, func(b Block) {
+			rows, next := b.From("posts").Get("post1").Rel("comments").GetPage(2, cursor)
+			b.Return(rows, next)
+		})
+
+		vals := ret.GetAll()
+		for _, row := range vals[0].(nrv.Array) {
+			ids = append(ids, row.(nrv.Map)["id"].(int64))
+		}
+		cursor = vals[1]
+
+		// rows added after the first page aren't seen by next pages
+		if pages == 0 {
+			executeTestTrx(t, db, func(b Block) {
+				b.From("posts").Get("post1").Rel("comments").Set("comment6", nrv.Map{"id": int64(6)})
+			})
+		}
+	}
+
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Fatalf("Expected the 5 comments over the pages, got %v", ids)
+	}
+
+	ret := db.executeTransaction(db.NewTransaction(func(b Block) {
+		rows, _ := b.From("posts").Get("post1").Rel("comments").GetPage(2, "invalid")
+		b.Return(rows)
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Invalid cursor should fail")
+	}
+
+	// empty keys are resumed after
+	executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post2").Rel("comments")
+		comments.Set("", nrv.Map{"id": int64(1)})
+		comments.Set("comment2", nrv.Map{"id": int64(2)})
+	})
+	readTime := time.Now()
+
+	ids = make([]int64, 0)
+	cursor = nil
+	for pages := 0; pages == 0 || cursor != nil; pages++ {
+		if pages > 2 {
+			t.Fatalf("Too many pages, empty key not resumed after")
+		}
+
+		ret := executeTestTrx(t, db, func(b Block) {
+			rows, next := b.From("posts").Get("post2").Rel("comments").GetPage(1, cursor)
+			b.Return(rows, next)
+		})
+		vals := ret.GetAll()
+		for _, row := range vals[0].(nrv.Array) {
+			ids = append(ids, row.(nrv.Map)["id"].(int64))
+		}
+		cursor = vals[1]
+	}
+	if fmt.Sprint(ids) != "[1 2]" {
+		t.Fatalf("Expected both comments over the pages, got %v", ids)
+	}
+
+	// cursors can't read past the transaction's read time
+	executeTestTrx(t, db, func(b Block) {
+		b.From("posts").Get("post2").Rel("comments").Set("comment3", nrv.Map{"id": int64(3)})
+	})
+	forged, _ := encodeCursor(&TransactionCursor{
+		Table:   pb.String("posts/comments"),
+		Prefix:  []string{"post2"},
+		Time:    pb.Int64(time.Now().Add(time.Hour).UnixNano()),
+		LastKey: pb.String("comment2"),
+	})
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		rows, _ := b.From("posts").Get("post2").Rel("comments").GetPage(2, forged)
+		b.Return(rows)
+	}).AsOf(readTime), &nrv.RequestLogger{})
+	if ret.Error != nil || len(ret.GetAll()[0].(nrv.Array)) != 0 {
+		t.Fatalf("Expected forged cursor not to read rows written after the read time, got %v", ret)
+	}
+}
+
+func TestStream(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("posts").CreateSubTable("comments")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post1").Rel("comments")
+		for i := 1; i <= 7; i++ {
+			comments.Set("comment"+strconv.Itoa(i), nrv.Map{"id": int64(i)})
+		}
+	})
+
+	execute := func(trx Transactable) *TransactionReturn {
+		return db.executeTransaction(trx.GetTransaction(), &nrv.RequestLogger{})
+	}
+	query := func(b Block) BlockVariable {
+		return b.From("posts").Get("post1").Rel("comments")
+	}
+
+	// rows written while streaming aren't read, chunks reading rows as
+	// they were when the stream started
+	ids := make([]int64, 0)
+	err = db.stream(execute, query, 3, func(row interface{}) error {
+		ids = append(ids, row.(nrv.Map)["id"].(int64))
+		if len(ids) == 1 {
+			executeTestTrx(t, db, func(b Block) {
+				comments := b.From("posts").Get("post1").Rel("comments")
+				comments.Set("comment5", nrv.Map{"id": int64(50)})
+				comments.Set("comment8", nrv.Map{"id": int64(8)})
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 7 || ids[0] != 1 || ids[4] != 5 || ids[6] != 7 {
+		t.Fatalf("Expected the 7 comments in order, got %v", ids)
+	}
+
+	// callback error stops the stream
+	count := 0
+	err = db.stream(execute, query, 3, func(row interface{}) error {
+		count++
+		return errors.New("stop")
+	})
+	if err == nil || count != 1 {
+		t.Fatalf("Expected stream to stop at first error, got %v after %d rows", err, count)
+	}
+}
+
+func TestTransactionAsOf(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("users")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": "before"})
+	})
+	readTime := time.Now()
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": "after"})
+	})
+
+	ret := db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.From("users").Get("user1").Return()
+	}).AsOf(readTime), &nrv.RequestLogger{})
+	if ret.Error != nil {
+		t.Fatalf("Transaction failed: %s", *ret.Error.Message)
+	}
+	if vals := ret.GetAll(); len(vals) != 1 || vals[0].(nrv.Map)["name"] != "before" {
+		t.Fatalf("Expected row as it was before update, got %v", vals)
+	}
+
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": "past"})
+	}).AsOf(readTime), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Write in a read-only transaction should fail")
+	}
+
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.From("users").Delete("user1")
+	}).AsOf(readTime), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Delete in a read-only transaction should fail")
+	}
+}
+
+func TestTransactionHistory(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("users")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"first", "second"} {
+		executeTestTrx(t, db, func(b Block) {
+			b.Into("users").Set("user1", nrv.Map{"name": name})
+		})
+	}
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Delete("user1")
+	})
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("users").History("user1", time.Time{}, time.Time{}, 0))
+	})
+	versions := ret.GetAll()[0].(nrv.Array)
+	if len(versions) != 3 {
+		t.Fatalf("Expected 3 versions, got %v", versions)
+	}
+
+	deleted := versions[0].(nrv.Map)
+	if deleted["_deleted"] != true || deleted["_key1"] != "user1" {
+		t.Fatalf("Expected deletion as newest version, got %v", deleted)
+	}
+
+	second, first := versions[1].(nrv.Map), versions[2].(nrv.Map)
+	if second["name"] != "second" || first["name"] != "first" {
+		t.Fatalf("Expected versions newest first, got %v", versions)
+	}
+	if second["_timestamp"].(int64) <= first["_timestamp"].(int64) {
+		t.Fatalf("Expected versions to have increasing timestamps, got %v", versions)
+	}
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("users").History("user1", time.Time{}, time.Time{}, 1))
+	})
+	if versions := ret.GetAll()[0].(nrv.Array); len(versions) != 1 {
+		t.Fatalf("Expected history to be limited to 1 version, got %v", versions)
+	}
+}
+
+func TestTransactionCodec(t *testing.T) {
+	db := newTestDb(t)
+	table := db.CreateTable("users")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": "plain"})
+	})
+
+	db.Codec = GzipCodec
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user2", nrv.Map{"name": "gzipped"})
+	})
+
+	trx, _ := db.Storage.GetTransaction(nrv.Token(0), time.Now())
+	row, _ := trx.Get(table, []string{"user2"})
+	trx.Rollback()
+	if row == nil || row.Data[0] != codecHeaderMarker || row.Data[1] != GzipCodec.Id() {
+		t.Fatalf("Expected row to be encoded with gzip, got %v", row)
+	}
+
+	// rows stay readable whatever codec they were written with
+	db.Codec = SnappyCodec
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("users").Get("user1"))
+	})
+	if vals := ret.GetAll(); vals[0].(nrv.Map)["name"] != "plain" {
+		t.Fatalf("Expected row written without codec, got %v", vals)
+	}
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("users").Get("user2"))
+	})
+	if vals := ret.GetAll(); vals[0].(nrv.Map)["name"] != "gzipped" {
+		t.Fatalf("Expected row written with gzip, got %v", vals)
+	}
+}
+
+func TestTransactionMaxValueSize(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("users")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.MaxValueSize = 1024
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user1", nrv.Map{"name": strings.Repeat("a", 512)})
+	})
+
+	ret := db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Into("users").Set("user2", nrv.Map{"name": strings.Repeat("a", 2048)})
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil || !strings.Contains(*ret.Error.Message, "maximum value size") {
+		t.Fatalf("Expected value over the maximum size to fail, got %v", ret.Error)
+	}
+
+	// size is checked once encoded
+	db.Codec = GzipCodec
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user2", nrv.Map{"name": strings.Repeat("a", 2048)})
+	})
+
+	// and counts the bytes added by the storage
+	value := nrv.Map{"name": strings.Repeat("a", 512)}
+	data, _ := toTransactionValue(value).Marshall()
+	db.Codec = nil
+	db.MaxValueSize = len(data) + 10
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").Set("user3", value)
+	})
+
+	keys := &StaticKeyProvider{}
+	keys.AddKey(1, make([]byte, 16))
+	db.Storage = &EncryptedStorage{Storage: db.Storage, Keys: keys}
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Into("users").Set("user3", value)
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil || !strings.Contains(*ret.Error.Message, "maximum value size") {
+		t.Fatalf("Expected value over the maximum size once encrypted to fail, got %v", ret.Error)
+	}
+}
+
+func TestTransactionTTL(t *testing.T) {
+	db := newTestDb(t)
+	users := db.CreateTable("users")
+	sessions := users.CreateSubTable("sessions")
+	sessions.TTL = time.Millisecond
+	index, err := sessions.CreateIndex("device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").SetTTL("short", nrv.Map{"name": "short"}, time.Millisecond)
+	})
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").SetTTL("long", nrv.Map{"name": "long"}, time.Hour)
+	})
+	executeTestTrx(t, db, func(b Block) {
+		b.From("users").Get("long").Rel("sessions").Set("session1", nrv.Map{"device": "device1"})
+	})
+	beforeExpiry := time.Now()
+	time.Sleep(5 * time.Millisecond)
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("users").Get("short"))
+	})
+	if vals := ret.GetAll(); vals[0] != nil {
+		t.Fatalf("Expired row shouldn't be read, got %v", vals)
+	}
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		sessions := b.From("users").Get("long").Rel("sessions")
+		b.Return(b.From("users").Get("long"), sessions.GetAll(), sessions.Lookup("device", "device1"))
+	})
+	vals := ret.GetAll()
+	if vals[0] == nil || vals[0].(nrv.Map)["_expires"] != nil {
+		t.Fatalf("Row with a time to live should be read without its expiry, got %v", vals[0])
+	}
+	if len(vals[1].(nrv.Array)) != 0 || len(vals[2].(nrv.Array)) != 0 {
+		t.Fatalf("Row expired by its table's time to live shouldn't be read, got %v", vals)
+	}
+
+	// expired rows are still read in the past
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Return(b.From("users").Get("short"))
+	}).AsOf(beforeExpiry), &nrv.RequestLogger{})
+	if vals := ret.GetAll(); vals[0] == nil {
+		t.Fatalf("Row should be read before it expired, got %v", vals)
+	}
+
+	err = db.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := db.Storage.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Rollback()
+
+	history, _ := trx.GetHistory(users, []string{"short"}, time.Time{}, time.Time{}, 0)
+	if len(history) != 2 || !history[0].Deleted() {
+		t.Fatalf("Expired row should be deleted by the sweeper, got %v", history)
+	}
+	history, _ = trx.GetHistory(users, []string{"long"}, time.Time{}, time.Time{}, 0)
+	if len(history) != 1 {
+		t.Fatalf("Row not expired yet shouldn't be deleted, got %v", history)
+	}
+
+	iterator, _ := trx.GetQuery(StorageQuery{Table: index.Table(), TablePrefix: []string{"long"}})
+	defer iterator.Close()
+	if entry, _ := iterator.Next(); entry != nil {
+		t.Fatalf("Index entry of expired row should be deleted, got %v", entry)
+	}
+
+	// once swept, tables without time to live are only swept again if rows
+	// got set with one
+	if db.expiringTables[users] != true || len(db.expiringTables) != 1 {
+		t.Fatalf("Only the table with a row to expire later should be marked, got %v", db.expiringTables)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		b.Into("users").SetTTL("short", nrv.Map{"name": "short"}, time.Millisecond)
+	})
+	time.Sleep(5 * time.Millisecond)
+	err = db.Expire()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ = db.Storage.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Rollback()
+	history, _ = trx.GetHistory(users, []string{"short"}, time.Time{}, time.Time{}, 0)
+	if len(history) != 4 || !history[0].Deleted() {
+		t.Fatalf("Row set again with a time to live should be deleted by the sweeper, got %v", history)
+	}
+}
+
+func TestTransactionFilter(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("posts").CreateSubTable("comments")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post1").Rel("comments")
+		for i := 1; i <= 6; i++ {
+			author := "alice"
+			if i%2 == 0 {
+				author = "bob"
+			}
+			comments.Set("comment"+strconv.Itoa(i), nrv.Map{"score": int64(i), "author": author})
+		}
+	})
+
+	ids := func(val interface{}) []int64 {
+		ret := make([]int64, 0)
+		for _, row := range val.(nrv.Array) {
+			ret = append(ret, row.(nrv.Map)["score"].(int64))
+		}
+		return ret
+	}
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		comments := b.From("posts").Get("post1").Rel("comments")
+		filtered := comments.Filter(And(Gte("score", 2), Not(Eq("author", "bob"))))
+		byKey := comments.Filter(Gt("_key", "comment4"))
+		byQuery := comments.Query(QueryOptions{Limit: 2}).Filter(In("author", "bob"))
+		byArray := comments.GetAll().Filter(Lt("score", 3))
+		byArrayKey := comments.GetAll().Filter(Gt("_key", "comment4"))
+		bySubject := comments.Filter(And(On(nrv.Map{"_key1": "post1"}, Eq("_key", "post1")), Lt("score", 3)))
+		b.Return(filtered.GetAll(), byKey.GetAll(), byQuery.GetAll(), byArray, byArrayKey, bySubject.GetAll())
+	})
+
+	vals := ret.GetAll()
+	expected := [][]int64{{3, 5}, {5, 6}, {2, 4}, {1, 2}, {5, 6}, {1, 2}}
+	for i, exp := range expected {
+		got := ids(vals[i])
+		if fmt.Sprint(got) != fmt.Sprint(exp) {
+			t.Fatalf("Expected rows %v for filter %d, got %v", exp, i, got)
+		}
+	}
+
+	// pages only have matching rows
+	rows := make([]int64, 0)
+	var cursor interface{}
+	for pages := 0; pages == 0 || cursor != nil; pages++ {
+		ret := executeTestTrx(t, db, func(b Block) {
+			comments := b.From("posts").Get("post1").Rel("comments").Filter(Eq("author", "alice"))
+			page, next := comments.GetPage(2, cursor)
+			b.Return(page, next)
+		})
+		vals := ret.GetAll()
+		rows = append(rows, ids(vals[0])...)
+		cursor = vals[1]
+	}
+	if fmt.Sprint(rows) != "[1 3 5]" {
+		t.Fatalf("Expected matching rows over the pages, got %v", rows)
+	}
+
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Return(b.From("posts").Get("post1").Rel("comments").Filter(&TransactionPredicate{}).GetAll())
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Invalid predicate should fail")
+	}
+}
+
+func TestTransactionOrderLimit(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("games").CreateSubTable("scores")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		scores := b.From("games").Get("game1").Rel("scores")
+		for i, score := range []int64{30, 10, 50, 20, 40} {
+			scores.Set("player"+strconv.Itoa(i), nrv.Map{"player": int64(i), "score": score})
+		}
+	})
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		scores := b.From("games").Get("game1").Rel("scores").GetAll()
+		b.Return(scores.Order(Desc("score")).Limit(3))
+	})
+
+	top := make([]int64, 0)
+	for _, row := range ret.GetAll()[0].(nrv.Array) {
+		top = append(top, row.(nrv.Map)["score"].(int64))
+	}
+	if fmt.Sprint(top) != "[50 40 30]" {
+		t.Fatalf("Expected top 3 scores, got %v", top)
+	}
+
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.Return(b.From("games").Get("game1").Rel("scores").GetAll().Limit("three"))
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("Limit with an invalid count should fail")
+	}
+}
+
+func TestTransactionIf(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("accounts")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// creates the account only if it doesn't exist
+	create := func(balance int64) *TransactionReturn {
+		return executeTestTrx(t, db, func(b Block) {
+			accounts := b.From("accounts")
+			account := accounts.Get("account1")
+			b.If(Exists(account)).Then(func(b Block) {
+				b.Return("exists")
+			}).Else(func(b Block) {
+				accounts.Set("account1", nrv.Map{"balance": balance})
+			})
+			b.Return("created")
+		})
+	}
+
+	if ret := create(100).GetAll(); ret[0] != "created" {
+		t.Fatalf("Expected account to be created, got %v", ret)
+	}
+	if ret := create(200).GetAll(); ret[0] != "exists" {
+		t.Fatalf("Expected account to exist, got %v", ret)
+	}
+
+	// withdraws only if the balance is sufficient, nested blocks using
+	// variables of their parents
+	withdraw := func(amount int64) interface{} {
+		ret := executeTestTrx(t, db, func(b Block) {
+			accounts := b.From("accounts")
+			account := accounts.Get("account1")
+			b.If(Exists(account)).Then(func(b Block) {
+				b.If(On(account, Gte("balance", amount))).Then(func(b Block) {
+					accounts.Set("account1", nrv.Map{"balance": int64(100) - amount})
+					b.Return("withdrawn")
+				})
+			})
+			b.Return("refused")
+		})
+		return ret.GetAll()[0]
+	}
+
+	if ret := withdraw(150); ret != "refused" {
+		t.Fatalf("Expected withdrawal over the balance to be refused, got %v", ret)
+	}
+	if ret := withdraw(40); ret != "withdrawn" {
+		t.Fatalf("Expected withdrawal to succeed, got %v", ret)
+	}
+
+	ret := executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("accounts").Get("account1"))
+	})
+	if balance := ret.GetAll()[0].(nrv.Map)["balance"]; balance != int64(60) {
+		t.Fatalf("Expected balance of 60, got %v", balance)
+	}
+
+	// the untaken branch doesn't conflict with the token of the transaction
+	ret = executeTestTrx(t, db, func(b Block) {
+		accounts := b.From("accounts")
+		account := accounts.Get("account1")
+		b.If(Exists(account)).Then(func(b Block) {
+			b.Return("exists")
+		}).Else(func(b Block) {
+			accounts.Set("account2", nrv.Map{"balance": int64(0)})
+		})
+	})
+	if ret := ret.GetAll(); ret[0] != "exists" {
+		t.Fatalf("Expected account to exist, got %v", ret)
+	}
+
+	// but the branch that runs still does
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		accounts := b.From("accounts")
+		account := accounts.Get("account1")
+		b.If(Exists(account)).Then(func(b Block) {
+			accounts.Set("account2", nrv.Map{"balance": int64(0)})
+		})
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil || !strings.Contains(*ret.Error.Message, "Token conflict") {
+		t.Fatalf("Expected a token conflict, got %v", ret.Error)
+	}
+
+	// blocks of an if need to be its children
+	trx := db.NewTransaction(func(b Block) {
+		b.If(Exists(1))
+	})
+	trx.Blocks[0].Operations[0].If.ThenBlock = trx.Blocks[0].Id
+	ret = db.executeTransaction(trx, &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("If running its own block should fail")
+	}
+}
+
+func TestTransactionForEach(t *testing.T) {
+	db := newTestDb(t)
+	db.CreateTable("orders").CreateSubTable("items")
+	err := db.SyncModel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executeTestTrx(t, db, func(b Block) {
+		items := b.From("orders").Get("order1").Rel("items")
+		items.Set("item1", nrv.Map{"product": "book", "status": "pending"})
+		items.Set("item2", nrv.Map{"product": "pen", "status": "cancelled"})
+		items.Set("item3", nrv.Map{"product": "lamp", "status": "pending"})
+	})
+
+	// ships every pending item in one transaction
+	ret := executeTestTrx(t, db, func(b Block) {
+		items := b.From("orders").Get("order1").Rel("items")
+		shipped := items.GetAll().Filter(Eq("status", "pending")).ForEach(func(b Block, item BlockVariable) {
+			item.Set("status", "shipped")
+			items.Set(item.Get("_key2"), item)
+		})
+		b.Return(shipped)
+	})
+
+	shipped := ret.GetAll()[0].(nrv.Array)
+	if len(shipped) != 2 || shipped[0].(nrv.Map)["status"] != "shipped" || shipped[1].(nrv.Map)["product"] != "lamp" {
+		t.Fatalf("Expected the 2 pending items to be returned shipped, got %v", shipped)
+	}
+
+	ret = executeTestTrx(t, db, func(b Block) {
+		b.Return(b.From("orders").Get("order1").Rel("items").GetAll())
+	})
+	statuses := make([]interface{}, 0)
+	for _, item := range ret.GetAll()[0].(nrv.Array) {
+		statuses = append(statuses, item.(nrv.Map)["status"])
+	}
+	if fmt.Sprint(statuses) != "[shipped cancelled shipped]" {
+		t.Fatalf("Expected pending items to be stored shipped, got %v", statuses)
+	}
+
+	// returning from the body stops the transaction
+	ret = executeTestTrx(t, db, func(b Block) {
+		items := b.From("orders").Get("order1").Rel("items")
+		items.GetAll().ForEach(func(b Block, item BlockVariable) {
+			b.If(On(item, Eq("status", "cancelled"))).Then(func(b Block) {
+				b.Return(item.Get("product"))
+			})
+		})
+		b.Return(nil)
+	})
+	if product := ret.GetAll()[0]; product != "pen" {
+		t.Fatalf("Expected the cancelled item to be returned, got %v", product)
+	}
+
+	// the body of an empty loop doesn't conflict with the token of the
+	// transaction
+	ret = executeTestTrx(t, db, func(b Block) {
+		items := b.From("orders").Get("order2").Rel("items").GetAll()
+		b.Return(items.ForEach(func(b Block, item BlockVariable) {
+			b.From("orders").Set("order3", nrv.Map{"status": "pending"})
+		}))
+	})
+	if items := ret.GetAll()[0].(nrv.Array); len(items) != 0 {
+		t.Fatalf("Expected no items, got %v", items)
+	}
+
+	ret = db.executeTransaction(db.NewTransaction(func(b Block) {
+		b.From("orders").Get("order1").ForEach(func(b Block, item BlockVariable) {})
+	}), &nrv.RequestLogger{})
+	if ret.Error == nil {
+		t.Fatalf("ForEach on a row should fail")
+	}
+}
@@ -0,0 +1,165 @@
+package mry
+
+import (
+	"bytes"
+	pb "code.google.com/p/goprotobuf/proto"
+	"github.com/appaquet/nrv"
+	"sort"
+)
+
+// Orders maps by the field, ascending
+func Asc(field string) *TransactionOrdering {
+	return &TransactionOrdering{Field: pb.String(field)}
+}
+
+// Orders maps by the field, descending
+func Desc(field string) *TransactionOrdering {
+	return &TransactionOrdering{Field: pb.String(field), Descending: pb.Bool(true)}
+}
+
+// Sorts the values, maps, by the orderings. Values equal by all orderings
+// keep their order.
+func orderValues(values []*TransactionCollectionValue, orderings []*TransactionOrdering) []*TransactionCollectionValue {
+	maps := make([]nrv.Map, len(values))
+	for i, value := range values {
+		if value.Value != nil {
+			maps[i], _ = value.Value.ToInterface().(nrv.Map)
+		}
+	}
+
+	sorter := &valuesSorter{values, maps, orderings}
+	sort.Stable(sorter)
+	return sorter.values
+}
+
+type valuesSorter struct {
+	values    []*TransactionCollectionValue
+	maps      []nrv.Map
+	orderings []*TransactionOrdering
+}
+
+func (s *valuesSorter) Len() int {
+	return len(s.values)
+}
+
+func (s *valuesSorter) Swap(i, j int) {
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+	s.maps[i], s.maps[j] = s.maps[j], s.maps[i]
+}
+
+func (s *valuesSorter) Less(i, j int) bool {
+	for _, ordering := range s.orderings {
+		cmp := collate(s.maps[i][*ordering.Field], s.maps[j][*ordering.Field])
+		if ordering.Descending != nil && *ordering.Descending {
+			cmp = -cmp
+		}
+
+		if cmp != 0 {
+			return cmp < 0
+		}
+	}
+	return false
+}
+
+// Rank of types in the collation
+const (
+	collateNil = iota
+	collateBool
+	collateNumber
+	collateString
+	collateBytes
+	collateArray
+	collateMap
+)
+
+func collateRank(v interface{}) int {
+	if _, ok := toFloat64(v); ok {
+		return collateNumber
+	}
+
+	switch v.(type) {
+	case bool:
+		return collateBool
+	case string:
+		return collateString
+	case []byte:
+		return collateBytes
+	case nrv.Array, []interface{}:
+		return collateArray
+	case nrv.Map, map[string]interface{}:
+		return collateMap
+	}
+	return collateNil
+}
+
+// Compares two values of any type. Values of different types are ordered
+// missing, bool, number, string, bytes, array and map. Numbers are compared
+// whatever their type, arrays by their values, and maps by their sorted
+// fields and then their values.
+func collate(v1, v2 interface{}) int {
+	rank1, rank2 := collateRank(v1), collateRank(v2)
+	if rank1 != rank2 {
+		return compareInt64(int64(rank1), int64(rank2))
+	}
+
+	switch rank1 {
+	case collateBool, collateNumber, collateString:
+		cmp, _ := compareValues(v1, v2)
+		return cmp
+
+	case collateBytes:
+		return bytes.Compare(v1.([]byte), v2.([]byte))
+
+	case collateArray:
+		a1, a2 := toInterfaceSlice(v1), toInterfaceSlice(v2)
+		for i := 0; i < len(a1) && i < len(a2); i++ {
+			if cmp := collate(a1[i], a2[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		return compareInt64(int64(len(a1)), int64(len(a2)))
+
+	case collateMap:
+		m1, m2 := toInterfaceMap(v1), toInterfaceMap(v2)
+		keys1, keys2 := sortedKeys(m1), sortedKeys(m2)
+		for i := 0; i < len(keys1) && i < len(keys2); i++ {
+			if cmp := collate(keys1[i], keys2[i]); cmp != 0 {
+				return cmp
+			}
+		}
+		if cmp := compareInt64(int64(len(keys1)), int64(len(keys2))); cmp != 0 {
+			return cmp
+		}
+
+		for _, key := range keys1 {
+			if cmp := collate(m1[key], m2[key]); cmp != 0 {
+				return cmp
+			}
+		}
+	}
+
+	return 0
+}
+
+func toInterfaceSlice(v interface{}) []interface{} {
+	if array, ok := v.(nrv.Array); ok {
+		return []interface{}(array)
+	}
+	return v.([]interface{})
+}
+
+func toInterfaceMap(v interface{}) map[string]interface{} {
+	if m, ok := v.(nrv.Map); ok {
+		return map[string]interface{}(m)
+	}
+	return v.(map[string]interface{})
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,69 @@
+package mry
+
+import (
+	"github.com/appaquet/nrv"
+	"testing"
+)
+
+func TestCollate(t *testing.T) {
+	// values in collation order
+	ordered := []interface{}{
+		nil,
+		false,
+		true,
+		int64(-1),
+		0.5,
+		int64(1),
+		"",
+		"a",
+		"b",
+		[]byte{0},
+		nrv.Array{int64(1)},
+		nrv.Array{int64(1), int64(2)},
+		nrv.Array{int64(2)},
+		nrv.Map{"a": int64(2)},
+		nrv.Map{"a": int64(1), "b": int64(1)},
+		nrv.Map{"b": int64(1)},
+	}
+
+	for i := range ordered {
+		for j := range ordered {
+			cmp := collate(ordered[i], ordered[j])
+			if (i < j && cmp >= 0) || (i == j && cmp != 0) || (i > j && cmp <= 0) {
+				t.Fatalf("Expected %v and %v to collate in order, got %d", ordered[i], ordered[j], cmp)
+			}
+		}
+	}
+
+	if collate(int64(1), 1.0) != 0 {
+		t.Fatalf("Expected numbers of different types to be equal")
+	}
+}
+
+func TestOrderValues(t *testing.T) {
+	values := make([]*TransactionCollectionValue, 0)
+	for _, m := range []nrv.Map{
+		{"id": int64(1), "score": int64(2), "name": "b"},
+		{"id": int64(2), "score": int64(3), "name": "a"},
+		{"id": int64(3), "score": int64(2), "name": "a"},
+		{"id": int64(4), "name": "c"},
+		{"id": int64(5), "score": int64(2), "name": "a"},
+	} {
+		values = append(values, &TransactionCollectionValue{Value: toTransactionValue(m)})
+	}
+
+	values = orderValues(values, []*TransactionOrdering{Desc("score"), Asc("name")})
+
+	ids := make([]int64, len(values))
+	for i, value := range values {
+		ids[i] = value.Value.ToInterface().(nrv.Map)["id"].(int64)
+	}
+
+	// equal values keep their order, missing fields come last descending
+	expected := []int64{2, 3, 5, 1, 4}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatalf("Expected values ordered as %v, got %v", expected, ids)
+		}
+	}
+}
@@ -0,0 +1,460 @@
+package mry
+
+import (
+	"bytes"
+	pb "code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"strconv"
+)
+
+// Fields of rows that aren't in their value
+const (
+	// Key of a row in its table
+	predicateKeyField = "_key"
+
+	// Time at which the row's version was written, in nanoseconds
+	predicateTimestampField = "_timestamp"
+)
+
+//
+// Predicates built by clients for Filter and If. Fields are fields of maps,
+// rows of tables also having their key in "_key" and the time of their
+// version in "_timestamp". Values can be variables of the transaction.
+// Comparing to nil with Eq or Ne tells whether the field is missing.
+//
+
+func Eq(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_EQ, field, value)
+}
+
+func Ne(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_NE, field, value)
+}
+
+func Lt(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_LT, field, value)
+}
+
+func Lte(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_LTE, field, value)
+}
+
+func Gt(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_GT, field, value)
+}
+
+func Gte(field string, value interface{}) *TransactionPredicate {
+	return newComparison(TransactionPredicate_GTE, field, value)
+}
+
+// Matches maps whose field is equal to one of the values
+func In(field string, values ...interface{}) *TransactionPredicate {
+	objects := make([]*TransactionObject, len(values))
+	for i, value := range values {
+		objects[i] = toObject(value)
+	}
+
+	return &TransactionPredicate{
+		Operator: TransactionPredicate_IN.Enum(),
+		Field:    pb.String(field),
+		Values:   objects,
+	}
+}
+
+func And(predicates ...*TransactionPredicate) *TransactionPredicate {
+	return &TransactionPredicate{
+		Operator: TransactionPredicate_AND.Enum(),
+		Operands: predicates,
+	}
+}
+
+func Or(predicates ...*TransactionPredicate) *TransactionPredicate {
+	return &TransactionPredicate{
+		Operator: TransactionPredicate_OR.Enum(),
+		Operands: predicates,
+	}
+}
+
+func Not(predicate *TransactionPredicate) *TransactionPredicate {
+	return &TransactionPredicate{
+		Operator: TransactionPredicate_NOT.Enum(),
+		Operands: []*TransactionPredicate{predicate},
+	}
+}
+
+// Evaluates the predicate on the fields of the subject, a variable or a
+// value, instead of the maps being filtered. An empty field is the subject
+// itself.
+func On(subject interface{}, predicate *TransactionPredicate) *TransactionPredicate {
+	predicate.Subject = toObject(subject)
+	return predicate
+}
+
+// Matches if the subject, such as a row got from a table, isn't nil
+func Exists(subject interface{}) *TransactionPredicate {
+	return On(subject, Ne("", nil))
+}
+
+func newComparison(operator TransactionPredicate_Operator, field string, value interface{}) *TransactionPredicate {
+	return &TransactionPredicate{
+		Operator: operator.Enum(),
+		Field:    pb.String(field),
+		Values:   []*TransactionObject{toObject(value)},
+	}
+}
+
+// Predicate evaluated by the server, its values resolved
+type serverPredicate struct {
+	operator TransactionPredicate_Operator
+	field    string
+	values   []interface{}
+	operands []*serverPredicate
+
+	// fields are the subject's if it's set
+	hasSubject bool
+	subject    interface{}
+}
+
+// Resolves the values of the predicate and checks its structure
+func newServerPredicate(context *transactionContext, predicate *TransactionPredicate) (*serverPredicate, error) {
+	if predicate == nil || predicate.Operator == nil {
+		return nil, errors.New("Predicate has no operator")
+	}
+
+	sp := &serverPredicate{
+		operator: *predicate.Operator,
+	}
+	if predicate.Field != nil {
+		sp.field = *predicate.Field
+	}
+
+	for _, value := range predicate.Values {
+		sp.values = append(sp.values, value.getValue(context).ToInterface())
+	}
+
+	if predicate.Subject != nil {
+		sp.hasSubject = true
+		sp.subject = predicate.Subject.getValue(context).ToInterface()
+	}
+
+	for _, operand := range predicate.Operands {
+		spOperand, err := newServerPredicate(context, operand)
+		if err != nil {
+			return nil, err
+		}
+		sp.operands = append(sp.operands, spOperand)
+	}
+
+	switch sp.operator {
+	case TransactionPredicate_EQ, TransactionPredicate_NE, TransactionPredicate_LT, TransactionPredicate_LTE, TransactionPredicate_GT, TransactionPredicate_GTE:
+		if len(sp.values) != 1 {
+			return nil, errors.New(fmt.Sprintf("Predicate %s needs a value", sp.operator))
+		}
+	case TransactionPredicate_IN:
+	case TransactionPredicate_AND, TransactionPredicate_OR:
+		if len(sp.operands) == 0 {
+			return nil, errors.New(fmt.Sprintf("Predicate %s needs operands", sp.operator))
+		}
+	case TransactionPredicate_NOT:
+		if len(sp.operands) != 1 {
+			return nil, errors.New("Predicate NOT needs one operand")
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("Unsupported predicate operator %d", sp.operator))
+	}
+
+	return sp, nil
+}
+
+// Returns a predicate matching both predicates, nil ones matching anything
+func andServerPredicates(p1, p2 *serverPredicate) *serverPredicate {
+	if p1 == nil {
+		return p2
+	} else if p2 == nil {
+		return p1
+	}
+
+	return &serverPredicate{
+		operator: TransactionPredicate_AND,
+		operands: []*serverPredicate{p1, p2},
+	}
+}
+
+// Returns true if the fields returned by the function match the predicate.
+// Comparisons on missing fields or values of different types don't match,
+// unless comparing to nil.
+func (sp *serverPredicate) matches(fields func(field string) (interface{}, bool)) bool {
+	if sp.hasSubject {
+		fields = valueFields(sp.subject)
+	}
+
+	switch sp.operator {
+	case TransactionPredicate_AND:
+		for _, operand := range sp.operands {
+			if !operand.matches(fields) {
+				return false
+			}
+		}
+		return true
+
+	case TransactionPredicate_OR:
+		for _, operand := range sp.operands {
+			if operand.matches(fields) {
+				return true
+			}
+		}
+		return false
+
+	case TransactionPredicate_NOT:
+		return !sp.operands[0].matches(fields)
+	}
+
+	fieldValue, found := fields(sp.field)
+	if sp.operator == TransactionPredicate_EQ && sp.values[0] == nil {
+		return !found || fieldValue == nil
+	} else if sp.operator == TransactionPredicate_NE && sp.values[0] == nil {
+		return found && fieldValue != nil
+	} else if !found {
+		return false
+	}
+
+	// keys are strings, whatever the type of the value they got set with
+	values := sp.values
+	if sp.field == predicateKeyField {
+		values = make([]interface{}, len(sp.values))
+		for i, value := range sp.values {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+
+	if sp.operator == TransactionPredicate_IN {
+		for _, value := range values {
+			if cmp, ok := compareValues(fieldValue, value); ok && cmp == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	cmp, ok := compareValues(fieldValue, values[0])
+	if !ok {
+		return false
+	}
+
+	switch sp.operator {
+	case TransactionPredicate_EQ:
+		return cmp == 0
+	case TransactionPredicate_NE:
+		return cmp != 0
+	case TransactionPredicate_LT:
+		return cmp < 0
+	case TransactionPredicate_LTE:
+		return cmp <= 0
+	case TransactionPredicate_GT:
+		return cmp > 0
+	case TransactionPredicate_GTE:
+		return cmp >= 0
+	}
+	return false
+}
+
+// Returns true if the row matches the predicate
+func (sp *serverPredicate) matchesRow(value interface{}, row *Row) bool {
+	m, _ := value.(nrv.Map)
+	return sp.matches(func(field string) (interface{}, bool) {
+		switch field {
+		case "":
+			return value, true
+		case predicateKeyField:
+			return row.Keys[len(row.Keys)-1], true
+		case predicateTimestampField:
+			return row.IntTimestamp, true
+		}
+
+		fieldValue, found := m[field]
+		return fieldValue, found
+	})
+}
+
+// Returns true if the value, a map, matches the predicate
+func (sp *serverPredicate) matchesValue(value interface{}) bool {
+	return sp.matches(valueFields(value))
+}
+
+// Returns the fields of the value, a map, the empty field being the value.
+// Rows read by a transaction have their key as their last _keyN field.
+func valueFields(value interface{}) func(field string) (interface{}, bool) {
+	m, _ := value.(nrv.Map)
+	return func(field string) (interface{}, bool) {
+		switch field {
+		case "":
+			return value, true
+		case predicateKeyField:
+			if _, found := m[predicateKeyField]; !found {
+				return lastRowKey(m)
+			}
+		}
+
+		fieldValue, found := m[field]
+		return fieldValue, found
+	}
+}
+
+// Returns the last of the _key1.._keyN fields of a row
+func lastRowKey(m nrv.Map) (interface{}, bool) {
+	var key interface{}
+	found := false
+	for i := 1; ; i++ {
+		k, ok := m[predicateKeyField+strconv.Itoa(i)]
+		if !ok {
+			return key, found
+		}
+		key, found = k, true
+	}
+}
+
+// Narrows the bounds of the query to the keys the predicate can match, so
+// that the storage doesn't scan rows that would be filtered out anyway
+func (sp *serverPredicate) narrowQuery(query *StorageQuery) {
+	// the predicate is on its subject, not on the rows
+	if sp.hasSubject {
+		return
+	}
+
+	switch sp.operator {
+	case TransactionPredicate_AND:
+		for _, operand := range sp.operands {
+			operand.narrowQuery(query)
+		}
+		return
+
+	case TransactionPredicate_OR, TransactionPredicate_NOT, TransactionPredicate_NE, TransactionPredicate_IN:
+		return
+	}
+
+	if sp.field != predicateKeyField {
+		return
+	}
+
+	key := fmt.Sprint(sp.values[0])
+	switch sp.operator {
+	case TransactionPredicate_EQ:
+		narrowQueryStart(query, key, false)
+		narrowQueryEnd(query, key, false)
+	case TransactionPredicate_GT:
+		narrowQueryStart(query, key, true)
+	case TransactionPredicate_GTE:
+		narrowQueryStart(query, key, false)
+	case TransactionPredicate_LT:
+		narrowQueryEnd(query, key, true)
+	case TransactionPredicate_LTE:
+		narrowQueryEnd(query, key, false)
+	}
+}
+
+func narrowQueryStart(query *StorageQuery, key string, exclusive bool) {
+	if !query.hasStartKey() || key > query.StartKey {
+		query.StartKey = key
+		query.StartExclusive = exclusive
+	} else if key == query.StartKey {
+		query.StartExclusive = query.StartExclusive || exclusive
+	}
+}
+
+func narrowQueryEnd(query *StorageQuery, key string, exclusive bool) {
+	if !query.hasEndKey() || key < query.EndKey {
+		query.EndKey = key
+		query.EndExclusive = exclusive
+	} else if key == query.EndKey {
+		query.EndExclusive = query.EndExclusive || exclusive
+	}
+}
+
+// Compares two values, returning false if they can't be compared. Numbers
+// are compared whatever their type.
+func compareValues(v1, v2 interface{}) (int, bool) {
+	if i1, ok := toInt64(v1); ok {
+		if i2, ok := toInt64(v2); ok {
+			return compareInt64(i1, i2), true
+		}
+	}
+
+	if f1, ok := toFloat64(v1); ok {
+		if f2, ok := toFloat64(v2); ok {
+			if f1 < f2 {
+				return -1, true
+			} else if f1 > f2 {
+				return 1, true
+			}
+			return 0, true
+		}
+	}
+
+	switch t1 := v1.(type) {
+	case string:
+		if t2, ok := v2.(string); ok {
+			if t1 < t2 {
+				return -1, true
+			} else if t1 > t2 {
+				return 1, true
+			}
+			return 0, true
+		}
+	case bool:
+		if t2, ok := v2.(bool); ok {
+			if t1 == t2 {
+				return 0, true
+			} else if t2 {
+				return -1, true
+			}
+			return 1, true
+		}
+	case []byte:
+		if t2, ok := v2.([]byte); ok {
+			return bytes.Compare(t1, t2), true
+		}
+	}
+
+	return 0, false
+}
+
+func compareInt64(i1, i2 int64) int {
+	if i1 < i2 {
+		return -1
+	} else if i1 > i2 {
+		return 1
+	}
+	return 0
+}
+
+func toInt64(v interface{}) (int64, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), true
+	case int32:
+		return int64(t), true
+	case int64:
+		return t, true
+	case uint32:
+		return int64(t), true
+	case uint64:
+		return int64(t), true
+	}
+	return 0, false
+}
+
+func toFloat64(v interface{}) (float64, bool) {
+	if i, ok := toInt64(v); ok {
+		return float64(i), true
+	}
+
+	switch t := v.(type) {
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
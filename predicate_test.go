@@ -0,0 +1,123 @@
+package mry
+
+import (
+	"github.com/appaquet/nrv"
+	"testing"
+)
+
+func newTestPredicate(t *testing.T, predicate *TransactionPredicate) *serverPredicate {
+	sp, err := newServerPredicate(&transactionContext{}, predicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func TestPredicateMatches(t *testing.T) {
+	value := nrv.Map{"name": "alice", "age": int64(30), "score": 4.5, "admin": true}
+
+	expected := []struct {
+		predicate *TransactionPredicate
+		matches   bool
+	}{
+		{Eq("name", "alice"), true},
+		{Eq("name", "bob"), false},
+		{Ne("name", "bob"), true},
+		{Eq("age", 30), true},
+		{Gt("age", 29.5), true},
+		{Lte("score", 4), false},
+		{Lt("name", "bob"), true},
+		{Eq("admin", true), true},
+		{Eq("missing", "alice"), false},
+		{Ne("missing", "alice"), false},
+		{Eq("age", "30"), false},
+		{In("name", "bob", "alice"), true},
+		{In("name", "bob", "carol"), false},
+		{And(Eq("name", "alice"), Gte("age", 30)), true},
+		{And(Eq("name", "alice"), Gt("age", 30)), false},
+		{Or(Eq("name", "bob"), Gt("age", 20)), true},
+		{Not(Eq("name", "alice")), false},
+		{Not(Eq("missing", "alice")), true},
+		{Eq("missing", nil), true},
+		{Ne("name", nil), true},
+		{On(nrv.Map{"age": int64(10)}, Gt("age", 20)), false},
+		{On(int64(3), Eq("", 3)), true},
+		{Exists(nil), false},
+		{Exists(nrv.Map{}), true},
+	}
+
+	for _, exp := range expected {
+		if matches := newTestPredicate(t, exp.predicate).matchesValue(value); matches != exp.matches {
+			t.Fatalf("Expected %v for predicate %s, got %v", exp.matches, exp.predicate, matches)
+		}
+	}
+}
+
+func TestPredicateRowFields(t *testing.T) {
+	row := &Row{IntTimestamp: 10, Keys: []string{"post1", "comment2"}}
+
+	if !newTestPredicate(t, Eq("_key", "comment2")).matchesRow(nrv.Map{}, row) {
+		t.Fatalf("Expected predicate on the row's key to match")
+	}
+	if !newTestPredicate(t, Gt("_timestamp", 5)).matchesRow(nrv.Map{}, row) {
+		t.Fatalf("Expected predicate on the row's timestamp to match")
+	}
+}
+
+func TestPredicateRowKeyField(t *testing.T) {
+	// rows read by a transaction, such as the ones of GetAll
+	row := nrv.Map{"_key1": "post1", "_key2": "comment2", "_timestamp": int64(10)}
+
+	if !newTestPredicate(t, Eq("_key", "comment2")).matchesValue(row) {
+		t.Fatalf("Expected predicate on the row's key to match")
+	}
+	if newTestPredicate(t, Eq("_key", "post1")).matchesValue(row) {
+		t.Fatalf("Expected predicate on the row's key not to match its parent's key")
+	}
+	if newTestPredicate(t, Eq("_key", "comment2")).matchesValue(nrv.Map{}) {
+		t.Fatalf("Expected predicate on the key of a map without keys not to match")
+	}
+}
+
+func TestPredicateNarrowQuery(t *testing.T) {
+	query := &StorageQuery{StartKey: "b"}
+	newTestPredicate(t, And(Gte("_key", "a"), Lt("_key", "d"), Eq("name", "alice"))).narrowQuery(query)
+	if query.StartKey != "b" || query.StartExclusive || query.EndKey != "d" || !query.EndExclusive {
+		t.Fatalf("Expected query to be narrowed to [b, d), got %v", query)
+	}
+
+	query = &StorageQuery{}
+	newTestPredicate(t, Eq("_key", "c")).narrowQuery(query)
+	if query.StartKey != "c" || query.EndKey != "c" || query.StartExclusive || query.EndExclusive {
+		t.Fatalf("Expected query to be narrowed to [c, c], got %v", query)
+	}
+
+	// keys of an OR can't be bounded
+	query = &StorageQuery{}
+	newTestPredicate(t, Or(Eq("_key", "a"), Eq("_key", "c"))).narrowQuery(query)
+	if query.StartKey != "" || query.EndKey != "" {
+		t.Fatalf("Expected query not to be narrowed, got %v", query)
+	}
+
+	// nor keys of a subject
+	query = &StorageQuery{}
+	newTestPredicate(t, And(On(nrv.Map{}, Eq("_key", "c")), Gte("_key", "a"))).narrowQuery(query)
+	if query.StartKey != "a" || query.EndKey != "" {
+		t.Fatalf("Expected query to be narrowed by the rows' keys only, got %v", query)
+	}
+}
+
+func TestPredicateInvalid(t *testing.T) {
+	invalid := []*TransactionPredicate{
+		{},
+		{Operator: TransactionPredicate_EQ.Enum()},
+		{Operator: TransactionPredicate_AND.Enum()},
+		Not(nil),
+	}
+
+	for _, predicate := range invalid {
+		if _, err := newServerPredicate(&transactionContext{}, predicate); err == nil {
+			t.Fatalf("Expected predicate %s to be invalid", predicate)
+		}
+	}
+}
@@ -7,36 +7,105 @@ import (
 
 type Storage interface {
 	Init()
+
+	// Creates missing tables of the model, failing if the schema needs
+	// destructive changes that have to go through an explicit migration.
+	// Tables that aren't in the model anymore are left untouched.
 	SyncModel(model *Model) error
+
+	// Returns the steps needed to bring the schema in line with the model
+	PlanMigration(model *Model) (*MigrationPlan, error)
+
+	// Applies a migration plan, destructive steps needing to be allowed
+	ApplyMigration(plan *MigrationPlan, allowDestructive bool) error
+
 	GetTransaction(token nrv.Token, trxTime time.Time) (StorageTransaction, error)
 	Nuke() error
+
+	// Removes versions of the table's rows that are out of its retention
+	// policy as of now, keeping those needed to read the timeline from
+	// the horizon
+	Compact(table *Table, now time.Time, horizon time.Time) error
 }
 
+// Transaction on a storage. Every set or delete writes a new version of
+// the row at the transaction time, a deletion being written as a tombstone
+// version without data.
 type StorageTransaction interface {
 	Set(table *Table, keys []string, data []byte) error
+	Delete(table *Table, keys []string) error
 	Get(table *Table, keys []string) (*Row, error)
 	GetQuery(query StorageQuery) (RowIterator, error)
 	GetTimeline(table *Table, from time.Time, count int) ([]RowMutation, error)
+
+	// Returns the versions of a row written between from and to, newest
+	// first and tombstones included. Versions after the transaction time
+	// are never returned, so a zero to reads up to it. A zero limit returns
+	// every version.
+	GetHistory(table *Table, keys []string, from time.Time, to time.Time, limit int) ([]*Row, error)
+
 	Rollback() error
 	Commit() error
 }
 
+// Returns the time at which rows are read, which is the given time but
+// can't be after the transaction time, and is the transaction time if zero
+func readTimeAt(to time.Time, trxTime time.Time) time.Time {
+	if to.IsZero() || to.After(trxTime) {
+		return trxTime
+	}
+	return to
+}
+
+// Query on the rows of a table under a prefix of keys. Bounds apply to the
+// key following the prefix and are ignored when empty, unless exclusive
+// since an empty key is a valid one. Rows are ordered by
+// keys, and a zero limit returns every row. Rows are read as of Time, or
+// as of the transaction time if it's zero.
 type StorageQuery struct {
 	Table       *Table 
 	TablePrefix []string
 	Limit       int
+	Time        time.Time
+
+	StartKey       string
+	StartExclusive bool
+	EndKey         string
+	EndExclusive   bool
+	Reverse        bool
+}
+
+func (q *StorageQuery) hasStartKey() bool {
+	return q.StartKey != "" || q.StartExclusive
+}
+
+func (q *StorageQuery) hasEndKey() bool {
+	return q.EndKey != "" || q.EndExclusive
+}
+
+// Returns true if the key following the prefix is within the query's bounds
+func (q *StorageQuery) inBounds(key string) bool {
+	if q.hasStartKey() && (key < q.StartKey || (q.StartExclusive && key == q.StartKey)) {
+		return false
+	}
+	if q.hasEndKey() && (key > q.EndKey || (q.EndExclusive && key == q.EndKey)) {
+		return false
+	}
+	return true
 }
 
 type Row struct {
 	IntTimestamp int64
 	Timestamp    time.Time
-	Key1         string
-	Key2         string
-	Key3         string
-	Key4         string
+	Keys         []string
 	Data         []byte
 }
 
+// Returns true if the row is a deletion tombstone
+func (r *Row) Deleted() bool {
+	return len(r.Data) == 0
+}
+
 func (r *Row) ConvertTimestamp() {
 	r.Timestamp = time.Unix(0, r.IntTimestamp)
 }
@@ -44,10 +113,9 @@ func (r *Row) ConvertTimestamp() {
 func (r *Row) Reset() {
 	r.IntTimestamp = 0
 	r.Timestamp = time.Unix(0, 0)
-	r.Key1 = ""
-	r.Key2 = ""
-	r.Key3 = ""
-	r.Key4 = ""
+	for i := range r.Keys {
+		r.Keys[i] = ""
+	}
 	r.Data = nil
 }
 
@@ -56,6 +124,8 @@ type RowIterator interface {
 	Close()
 }
 
+// Mutation of a row. OldRow is empty if the row didn't exist before,
+// NewRow has no data if the row got deleted.
 type RowMutation struct {
 	OldRow      *Row
 	NewRow      *Row
@@ -0,0 +1,315 @@
+package mry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provides the keys encrypting rows of an EncryptedStorage. Keys are
+// identified so that they can be rotated, rows written with a previous key
+// staying readable as long as it's provided.
+type KeyProvider interface {
+	// Returns the key used to encrypt new rows and its id
+	CurrentKey() (id uint32, key []byte, err error)
+
+	// Returns the key with the given id, to decrypt rows
+	Key(id uint32) ([]byte, error)
+}
+
+// Key provider from keys kept in memory
+type StaticKeyProvider struct {
+	mutex   sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// Adds a key and makes it the one used for new rows. Keys need to be 16, 24
+// or 32 bytes long to select AES-128, AES-192 or AES-256.
+func (p *StaticKeyProvider) AddKey(id uint32, key []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.keys == nil {
+		p.keys = make(map[uint32][]byte)
+	}
+	p.keys[id] = key
+	p.current = id
+}
+
+func (p *StaticKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	key, found := p.keys[p.current]
+	if !found {
+		return 0, nil, errors.New("No key to encrypt rows")
+	}
+	return p.current, key, nil
+}
+
+func (p *StaticKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	key, found := p.keys[id]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Unknown key %d", id))
+	}
+	return key, nil
+}
+
+// Encrypted rows start with a codec header whose id is reserved, followed by
+// the id of the key, the nonce and the sealed data. Rows written before the
+// storage got encrypted have no such header.
+const encryptedCodecId byte = 255
+
+// Bytes added to the data of encrypted rows: the header, the key id, the
+// standard AES-GCM nonce and its tag
+const encryptionOverhead = 2 + 4 + 12 + 16
+
+// Storage decorator encrypting the data of rows with AES-GCM. The table and
+// keys of a row are authenticated with its data, so that encrypted data
+// can't be moved to another row. Keys aren't encrypted, which includes the
+// values of indexed fields since they are the keys of index entries, so
+// models having indexes are refused unless allowed.
+type EncryptedStorage struct {
+	Storage
+	Keys KeyProvider
+
+	// Reads rows without encryption header as is instead of failing, to
+	// migrate rows written before the storage got encrypted. Anyone able to
+	// write to the wrapped storage can then pass unauthenticated data.
+	AllowPlaintext bool
+
+	// Accepts models having indexes, whose indexed values are then stored
+	// in plaintext in the keys of index entries
+	AllowPlaintextIndexes bool
+}
+
+func (s *EncryptedStorage) SyncModel(model *Model) error {
+	_, err := syncModel(s, model)
+	return err
+}
+
+func (s *EncryptedStorage) PlanMigration(model *Model) (*MigrationPlan, error) {
+	if !s.AllowPlaintextIndexes {
+		for _, stored := range storedTables(model) {
+			if stored.index != nil {
+				return nil, errors.New(fmt.Sprintf("Index on field %s of table %s would store its values in plaintext", stored.index.Field, stored.table.parentTable.Path()))
+			}
+		}
+	}
+
+	return s.Storage.PlanMigration(model)
+}
+
+func (s *EncryptedStorage) GetTransaction(token nrv.Token, trxTime time.Time) (StorageTransaction, error) {
+	trx, err := s.Storage.GetTransaction(token, trxTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedStorageTransaction{trx, s}, nil
+}
+
+func (s *EncryptedStorage) dataOverhead() int {
+	overhead := encryptionOverhead
+	if storage, ok := s.Storage.(dataOverheader); ok {
+		overhead += storage.dataOverhead()
+	}
+	return overhead
+}
+
+func (s *EncryptedStorage) encrypt(table *Table, keys []string, data []byte) ([]byte, error) {
+	keyId, key, err := s.Keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 6, 6+gcm.NonceSize()+len(data)+gcm.Overhead())
+	header[0] = codecHeaderMarker
+	header[1] = encryptedCodecId
+	binary.BigEndian.PutUint32(header[2:6], keyId)
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(append(header, nonce...), nonce, data, encryptionData(table, keys)), nil
+}
+
+func (s *EncryptedStorage) decrypt(table *Table, keys []string, data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != codecHeaderMarker || data[1] != encryptedCodecId {
+		if s.AllowPlaintext {
+			return data, nil
+		}
+		return nil, errors.New("Row isn't encrypted")
+	}
+
+	if len(data) < 6 {
+		return nil, errors.New("Encrypted row has a truncated header")
+	}
+
+	key, err := s.Keys.Key(binary.BigEndian.Uint32(data[2:6]))
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < 6+gcm.NonceSize() {
+		return nil, errors.New("Encrypted row has a truncated nonce")
+	}
+	nonce := data[6 : 6+gcm.NonceSize()]
+
+	return gcm.Open(nil, nonce, data[6+gcm.NonceSize():], encryptionData(table, keys))
+}
+
+func (s *EncryptedStorage) decryptRow(table *Table, row *Row) error {
+	if row == nil || row.Deleted() {
+		return nil
+	}
+
+	data, err := s.decrypt(table, row.Keys, row.Data)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Couldn't decrypt row %s of table %s: %s", row.Keys, table.Path(), err))
+	}
+
+	row.Data = data
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Returns the data authenticated with the row's encrypted data
+func encryptionData(table *Table, keys []string) []byte {
+	return []byte(table.Path() + "\x00" + strings.Join(keys, "\x00"))
+}
+
+type encryptedStorageTransaction struct {
+	StorageTransaction
+	storage *EncryptedStorage
+}
+
+// Moves the time of the wrapped transaction, if it can be
+func (t *encryptedStorageTransaction) setTime(trxTime time.Time) {
+	if timed, ok := t.StorageTransaction.(timedStorageTransaction); ok {
+		timed.setTime(trxTime)
+	}
+}
+
+func (t *encryptedStorageTransaction) Set(table *Table, keys []string, data []byte) error {
+	if len(data) == 0 {
+		return t.StorageTransaction.Set(table, keys, data)
+	}
+
+	encrypted, err := t.storage.encrypt(table, keys, data)
+	if err != nil {
+		return err
+	}
+	return t.StorageTransaction.Set(table, keys, encrypted)
+}
+
+func (t *encryptedStorageTransaction) Get(table *Table, keys []string) (*Row, error) {
+	row, err := t.StorageTransaction.Get(table, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.storage.decryptRow(table, row)
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
+
+func (t *encryptedStorageTransaction) GetQuery(query StorageQuery) (RowIterator, error) {
+	iterator, err := t.StorageTransaction.GetQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedRowIterator{iterator, t.storage, query.Table}, nil
+}
+
+func (t *encryptedStorageTransaction) GetTimeline(table *Table, from time.Time, count int) ([]RowMutation, error) {
+	mutations, err := t.StorageTransaction.GetTimeline(table, from, count)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, mutation := range mutations {
+		err = t.storage.decryptRow(table, mutation.OldRow)
+		if err != nil {
+			return nil, err
+		}
+
+		err = t.storage.decryptRow(table, mutation.NewRow)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return mutations, nil
+}
+
+func (t *encryptedStorageTransaction) GetHistory(table *Table, keys []string, from time.Time, to time.Time, limit int) ([]*Row, error) {
+	rows, err := t.StorageTransaction.GetHistory(table, keys, from, to, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		err = t.storage.decryptRow(table, row)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+// RowIterator decrypting rows of the iterator it wraps
+type encryptedRowIterator struct {
+	RowIterator
+	storage *EncryptedStorage
+	table   *Table
+}
+
+func (i *encryptedRowIterator) Next() (*Row, error) {
+	row, err := i.RowIterator.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	err = i.storage.decryptRow(i.table, row)
+	if err != nil {
+		return nil, err
+	}
+	return row, nil
+}
@@ -0,0 +1,119 @@
+package mry
+
+import (
+	"bytes"
+	"github.com/appaquet/nrv"
+	"testing"
+	"time"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		keys := &StaticKeyProvider{}
+		keys.AddKey(1, bytes.Repeat([]byte{1}, 32))
+
+		s := &EncryptedStorage{Storage: &MemoryStorage{}, Keys: keys, AllowPlaintextIndexes: true}
+		s.Init()
+		return s
+	})
+}
+
+func TestEncryptedStorageKeys(t *testing.T) {
+	model := newModel()
+	table := model.CreateTable("users")
+
+	keys := &StaticKeyProvider{}
+	keys.AddKey(1, bytes.Repeat([]byte{1}, 32))
+
+	inner := &MemoryStorage{}
+	s := &EncryptedStorage{Storage: inner, Keys: keys}
+	s.Init()
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	set := func(trxTime time.Time, storage Storage, key string, data string) {
+		trx, _ := storage.GetTransaction(nrv.Token(0), trxTime)
+		err := trx.Set(table, []string{key}, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		trx.Commit()
+	}
+	get := func(storage Storage, key string) (*Row, error) {
+		trx, _ := storage.GetTransaction(nrv.Token(0), now.Add(10))
+		defer trx.Rollback()
+		return trx.Get(table, []string{key})
+	}
+
+	set(now, inner, "plain", "plain data")
+	set(now, s, "key1", "data1")
+	keys.AddKey(2, bytes.Repeat([]byte{2}, 16))
+	set(now, s, "key2", "data2")
+
+	// data is only stored encrypted, with the id of its key
+	for key, keyId := range map[string]byte{"key1": 1, "key2": 2} {
+		row, _ := get(inner, key)
+		if row == nil || bytes.Contains(row.Data, []byte("data")) || row.Data[1] != encryptedCodecId || row.Data[5] != keyId {
+			t.Fatalf("Expected row %s to be encrypted with key %d, got %v", key, keyId, row)
+		}
+	}
+
+	// rows written before encryption are only readable once allowed
+	if _, err := get(s, "plain"); err == nil {
+		t.Fatalf("Reading a row that isn't encrypted should fail")
+	}
+	s.AllowPlaintext = true
+
+	// rows stay readable after rotation, as well as rows written before encryption
+	expected := map[string]string{"plain": "plain data", "key1": "data1", "key2": "data2"}
+	for key, data := range expected {
+		row, err := get(s, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil || string(row.Data) != data {
+			t.Fatalf("Expected %s for row %s, got %v", data, key, row)
+		}
+	}
+
+	// encrypted data can't be moved to another row
+	row, _ := get(inner, "key1")
+	set(now.Add(1), inner, "key3", string(row.Data))
+	if _, err := get(s, "key3"); err == nil {
+		t.Fatalf("Decrypting data moved to another row should fail")
+	}
+
+	// rows can't be read without their key
+	s.Keys = &StaticKeyProvider{}
+	if _, err := get(s, "key1"); err == nil {
+		t.Fatalf("Decrypting without the row's key should fail")
+	}
+}
+
+func TestEncryptedStorageIndexes(t *testing.T) {
+	model := newModel()
+	_, err := model.CreateTable("users").CreateSubTable("posts").CreateIndex("title")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := &StaticKeyProvider{}
+	keys.AddKey(1, bytes.Repeat([]byte{1}, 32))
+
+	// indexed values would be stored in plaintext
+	s := &EncryptedStorage{Storage: &MemoryStorage{}, Keys: keys}
+	s.Init()
+	err = s.SyncModel(model)
+	if err == nil {
+		t.Fatalf("Syncing a model having indexes should fail")
+	}
+
+	s.AllowPlaintextIndexes = true
+	err = s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
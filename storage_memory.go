@@ -0,0 +1,533 @@
+package mry
+
+import (
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory storage. Every set is kept as a timestamped version,
+// exactly like the `t` column of the MySQL storage, so that reads
+// made at a given transaction time see the same data.
+type MemoryStorage struct {
+	mutex  sync.RWMutex
+	tables map[string]*memoryTable
+}
+
+func (m *MemoryStorage) Init() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.tables == nil {
+		m.tables = make(map[string]*memoryTable)
+	}
+}
+
+func (m *MemoryStorage) SyncModel(model *Model) error {
+	_, err := syncModel(m, model)
+	return err
+}
+
+func (m *MemoryStorage) PlanMigration(model *Model) (*MigrationPlan, error) {
+	m.Init()
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	liveTables := make(map[string]int)
+	for name, mTable := range m.tables {
+		liveTables[name] = mTable.depth
+	}
+
+	return planMigration(model, liveTables, (*Table).Path), nil
+}
+
+func (m *MemoryStorage) ApplyMigration(plan *MigrationPlan, allowDestructive bool) error {
+	err := plan.check(allowDestructive)
+	if err != nil {
+		return err
+	}
+
+	m.Init()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, step := range plan.Steps {
+		switch step.Action {
+		case MigrationCreateTable, MigrationRecreateTable:
+			m.tables[step.Table] = newMemoryTable(step.Depth)
+		case MigrationDropTable:
+			delete(m.tables, step.Table)
+		}
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) GetTransaction(token nrv.Token, trxTime time.Time) (StorageTransaction, error) {
+	m.Init()
+
+	return &MemoryStorageTransaction{
+		trxTime: trxTime,
+		storage: m,
+	}, nil
+}
+
+func (m *MemoryStorage) Nuke() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.tables = make(map[string]*memoryTable)
+	return nil
+}
+
+func (m *MemoryStorage) Compact(table *Table, now time.Time, horizon time.Time) error {
+	if !table.Retention.Enabled() {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	mTable, err := m.getTable(table)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range mTable.rows {
+		timestamps := make([]int64, len(row.versions))
+		for i, version := range row.versions {
+			timestamps[i] = version.timestamp
+		}
+
+		count := table.Retention.prunableVersions(timestamps, now, horizon)
+		row.versions = row.versions[count:]
+	}
+
+	return nil
+}
+
+func (m *MemoryStorage) getTable(table *Table) (*memoryTable, error) {
+	mTable, found := m.tables[table.Path()]
+	if !found {
+		return nil, errors.New(fmt.Sprintf("Table %s doesn't exist", table.Path()))
+	}
+	return mTable, nil
+}
+
+// Table kept in memory, with all versions of each row
+type memoryTable struct {
+	depth int
+	rows  map[string]*memoryRow
+}
+
+func newMemoryTable(depth int) *memoryTable {
+	return &memoryTable{
+		depth: depth,
+		rows:  make(map[string]*memoryRow),
+	}
+}
+
+// Returns rows matching the given keys prefix, sorted by keys
+func (t *memoryTable) prefixRows(prefix []string) []*memoryRow {
+	rows := make([]*memoryRow, 0)
+	for _, row := range t.rows {
+		if row.hasPrefix(prefix) {
+			rows = append(rows, row)
+		}
+	}
+
+	sort.Sort(memoryRowsByKeys(rows))
+	return rows
+}
+
+// Row kept in memory, with its versions ordered by timestamp
+type memoryRow struct {
+	keys     []string
+	versions []*memoryVersion
+}
+
+func (r *memoryRow) hasPrefix(prefix []string) bool {
+	if len(prefix) > len(r.keys) {
+		return false
+	}
+
+	for i, key := range prefix {
+		if r.keys[i] != key {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sets the data of the version at the given timestamp, replacing
+// it if the version already exists
+func (r *memoryRow) set(timestamp int64, data []byte) {
+	i := sort.Search(len(r.versions), func(i int) bool {
+		return r.versions[i].timestamp >= timestamp
+	})
+
+	if i < len(r.versions) && r.versions[i].timestamp == timestamp {
+		r.versions[i].data = data
+		return
+	}
+
+	r.versions = append(r.versions, nil)
+	copy(r.versions[i+1:], r.versions[i:])
+	r.versions[i] = &memoryVersion{timestamp, data}
+}
+
+// Returns the last version at or before the given timestamp
+func (r *memoryRow) versionAt(timestamp int64) *memoryVersion {
+	i := sort.Search(len(r.versions), func(i int) bool {
+		return r.versions[i].timestamp > timestamp
+	})
+
+	if i == 0 {
+		return nil
+	}
+	return r.versions[i-1]
+}
+
+func (r *memoryRow) toRow(version *memoryVersion) *Row {
+	row := &Row{
+		IntTimestamp: version.timestamp,
+		Data:         version.data,
+	}
+	row.ConvertTimestamp()
+
+	row.Keys = append([]string{}, r.keys...)
+
+	return row
+}
+
+type memoryRowsByKeys []*memoryRow
+
+func (s memoryRowsByKeys) Len() int      { return len(s) }
+func (s memoryRowsByKeys) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s memoryRowsByKeys) Less(i, j int) bool {
+	for k := 0; k < len(s[i].keys) && k < len(s[j].keys); k++ {
+		if s[i].keys[k] != s[j].keys[k] {
+			return s[i].keys[k] < s[j].keys[k]
+		}
+	}
+	return len(s[i].keys) < len(s[j].keys)
+}
+
+type memoryVersion struct {
+	timestamp int64
+	data      []byte
+}
+
+func memoryRowKey(keys []string) string {
+	return strings.Join(keys, "\x00")
+}
+
+// Transaction on the memory storage. Writes are kept in a private
+// copy of the touched rows until commit.
+type MemoryStorageTransaction struct {
+	trxTime time.Time
+	storage *MemoryStorage
+	pending map[*memoryTable]map[string]*memoryRow
+
+	// Times at which versions got written, the transaction time being
+	// movable
+	written map[int64]bool
+}
+
+func (t *MemoryStorageTransaction) setTime(trxTime time.Time) {
+	t.trxTime = trxTime
+}
+
+// Returns the row as seen by the transaction: the committed row merged
+// with the versions written by this transaction
+func (t *MemoryStorageTransaction) getRow(mTable *memoryTable, rowKey string) *memoryRow {
+	if rows, found := t.pending[mTable]; found {
+		if row, found := rows[rowKey]; found {
+			return row
+		}
+	}
+	return mTable.rows[rowKey]
+}
+
+func (t *MemoryStorageTransaction) Get(table *Table, keys []string) (*Row, error) {
+	t.storage.mutex.RLock()
+	defer t.storage.mutex.RUnlock()
+
+	mTable, err := t.storage.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	row := t.getRow(mTable, memoryRowKey(keys))
+	if row == nil {
+		return nil, nil
+	}
+
+	version := row.versionAt(t.trxTime.UnixNano())
+	if version == nil || len(version.data) == 0 {
+		return nil, nil
+	}
+
+	return row.toRow(version), nil
+}
+
+func (t *MemoryStorageTransaction) GetQuery(query StorageQuery) (RowIterator, error) {
+	t.storage.mutex.RLock()
+	defer t.storage.mutex.RUnlock()
+
+	mTable, err := t.storage.getTable(query.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// merge rows written by this transaction
+	rows := mTable.prefixRows(query.TablePrefix)
+	for i, row := range rows {
+		rows[i] = t.getRow(mTable, memoryRowKey(row.keys))
+	}
+	for rowKey, row := range t.pending[mTable] {
+		if _, found := mTable.rows[rowKey]; !found && row.hasPrefix(query.TablePrefix) {
+			rows = append(rows, row)
+		}
+	}
+	if query.Reverse {
+		sort.Sort(sort.Reverse(memoryRowsByKeys(rows)))
+	} else {
+		sort.Sort(memoryRowsByKeys(rows))
+	}
+
+	readTime := readTimeAt(query.Time, t.trxTime)
+
+	ret := make([]*Row, 0)
+	for _, row := range rows {
+		if query.Limit > 0 && len(ret) >= query.Limit {
+			break
+		}
+
+		if len(row.keys) > len(query.TablePrefix) && !query.inBounds(row.keys[len(query.TablePrefix)]) {
+			continue
+		}
+
+		version := row.versionAt(readTime.UnixNano())
+		if version != nil && len(version.data) > 0 {
+			ret = append(ret, row.toRow(version))
+		}
+	}
+
+	return &memoryRowIterator{ret}, nil
+}
+
+func (t *MemoryStorageTransaction) Set(table *Table, keys []string, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("Cannot set a row without data")
+	}
+
+	return t.write(table, keys, append([]byte{}, data...))
+}
+
+func (t *MemoryStorageTransaction) Delete(table *Table, keys []string) error {
+	return t.write(table, keys, nil)
+}
+
+// Writes a version of the row at transaction time, nil data being a tombstone
+func (t *MemoryStorageTransaction) write(table *Table, keys []string, data []byte) error {
+	t.storage.mutex.RLock()
+	defer t.storage.mutex.RUnlock()
+
+	mTable, err := t.storage.getTable(table)
+	if err != nil {
+		return err
+	}
+
+	if len(keys) != mTable.depth {
+		return errors.New(fmt.Sprintf("Table %s expects %d keys, got %d", table.Path(), mTable.depth, len(keys)))
+	}
+
+	if t.pending == nil {
+		t.pending = make(map[*memoryTable]map[string]*memoryRow)
+	}
+	if _, found := t.pending[mTable]; !found {
+		t.pending[mTable] = make(map[string]*memoryRow)
+	}
+
+	// copy committed row so that it stays untouched until commit
+	rowKey := memoryRowKey(keys)
+	row, found := t.pending[mTable][rowKey]
+	if !found {
+		row = &memoryRow{keys: append([]string{}, keys...)}
+		if committed, found := mTable.rows[rowKey]; found {
+			row.versions = make([]*memoryVersion, len(committed.versions))
+			for i, version := range committed.versions {
+				row.versions[i] = &memoryVersion{version.timestamp, version.data}
+			}
+		}
+		t.pending[mTable][rowKey] = row
+	}
+
+	row.set(t.trxTime.UnixNano(), data)
+
+	if t.written == nil {
+		t.written = make(map[int64]bool)
+	}
+	t.written[t.trxTime.UnixNano()] = true
+
+	return nil
+}
+
+func (t *MemoryStorageTransaction) GetTimeline(table *Table, from time.Time, count int) ([]RowMutation, error) {
+	t.storage.mutex.RLock()
+	defer t.storage.mutex.RUnlock()
+
+	mTable, err := t.storage.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := mTable.prefixRows([]string{})
+	for i, row := range rows {
+		rows[i] = t.getRow(mTable, memoryRowKey(row.keys))
+	}
+	for rowKey, row := range t.pending[mTable] {
+		if _, found := mTable.rows[rowKey]; !found {
+			rows = append(rows, row)
+		}
+	}
+
+	ret := make([]RowMutation, 0)
+	for _, row := range rows {
+		for i, version := range row.versions {
+			if version.timestamp < from.UnixNano() {
+				continue
+			}
+
+			oldRow := &Row{}
+			if i > 0 && len(row.versions[i-1].data) > 0 {
+				oldRow = row.toRow(row.versions[i-1])
+			}
+
+			ret = append(ret, RowMutation{
+				OldRow:      oldRow,
+				NewRow:      row.toRow(version),
+				LastVersion: i == len(row.versions)-1,
+			})
+		}
+	}
+
+	sort.Sort(rowMutationsByTime(ret))
+
+	if len(ret) > count {
+		ret = ret[:count]
+	}
+
+	return ret, nil
+}
+
+func (t *MemoryStorageTransaction) GetHistory(table *Table, keys []string, from time.Time, to time.Time, limit int) ([]*Row, error) {
+	t.storage.mutex.RLock()
+	defer t.storage.mutex.RUnlock()
+
+	mTable, err := t.storage.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Row, 0)
+	row := t.getRow(mTable, memoryRowKey(keys))
+	if row == nil {
+		return ret, nil
+	}
+
+	toTime := readTimeAt(to, t.trxTime)
+	for i := len(row.versions) - 1; i >= 0; i-- {
+		if limit > 0 && len(ret) >= limit {
+			break
+		}
+
+		version := row.versions[i]
+		if version.timestamp > toTime.UnixNano() {
+			continue
+		} else if version.timestamp < from.UnixNano() {
+			break
+		}
+
+		ret = append(ret, row.toRow(version))
+	}
+
+	return ret, nil
+}
+
+func (t *MemoryStorageTransaction) Rollback() error {
+	t.pending = nil
+	return nil
+}
+
+func (t *MemoryStorageTransaction) Commit() error {
+	t.storage.mutex.Lock()
+	defer t.storage.mutex.Unlock()
+
+	for mTable, rows := range t.pending {
+		for rowKey, row := range rows {
+			committed, found := mTable.rows[rowKey]
+			if !found {
+				committed = &memoryRow{keys: row.keys}
+				mTable.rows[rowKey] = committed
+			}
+
+			// only apply versions written by this transaction, other
+			// transactions may have committed in the meantime
+			for _, version := range row.versions {
+				if t.written[version.timestamp] {
+					committed.set(version.timestamp, version.data)
+				}
+			}
+		}
+	}
+	t.pending = nil
+	t.written = nil
+
+	return nil
+}
+
+type rowMutationsByTime []RowMutation
+
+func (s rowMutationsByTime) Len() int      { return len(s) }
+func (s rowMutationsByTime) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s rowMutationsByTime) Less(i, j int) bool {
+	a, b := s[i].NewRow, s[j].NewRow
+	if a.IntTimestamp != b.IntTimestamp {
+		return a.IntTimestamp < b.IntTimestamp
+	}
+
+	for k := 0; k < len(a.Keys) && k < len(b.Keys); k++ {
+		if a.Keys[k] != b.Keys[k] {
+			return a.Keys[k] < b.Keys[k]
+		}
+	}
+	return len(a.Keys) < len(b.Keys)
+}
+
+// RowIterator for memory storage
+type memoryRowIterator struct {
+	rows []*Row
+}
+
+func (i *memoryRowIterator) Next() (*Row, error) {
+	if len(i.rows) == 0 {
+		return nil, nil
+	}
+
+	row := i.rows[0]
+	i.rows = i.rows[1:]
+	return row, nil
+}
+
+func (i *memoryRowIterator) Close() {
+	i.rows = nil
+}
@@ -0,0 +1,13 @@
+package mry
+
+import (
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		s := &MemoryStorage{}
+		s.Init()
+		return s
+	})
+}
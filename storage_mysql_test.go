@@ -1,6 +1,9 @@
 package mry
 
 import (
+	"github.com/appaquet/nrv"
+	"github.com/go-sql-driver/mysql"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -12,6 +15,7 @@ func getStorage(t *testing.T, nuke bool) Storage {
 		Password: "mry_test",
 		Database: "mry_test",
 	}
+	s.Init()
 
 	if nuke {
 		err := s.Nuke()
@@ -23,268 +27,87 @@ func getStorage(t *testing.T, nuke bool) Storage {
 	return s
 }
 
-func TestGetSet(t *testing.T) {
-	s := getStorage(t, true)
-
-	model := newModel()
-	table := model.CreateTable("getset")
-	err := s.SyncModel(model)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	trx, err := s.GetTransaction(time.Now())
-	defer trx.Commit()
-
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = trx.Set(table, []string{"key1"}, []byte("value1"))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	row, err := trx.Get(table, []string{"key1"})
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if row == nil || string(row.Data) != "value1" {
-		t.Fatalf("Got different value than set: %s!=value1", row)
-	}
+func TestMysqlStorage(t *testing.T) {
+	testStorage(t, func(t *testing.T) Storage {
+		return getStorage(t, true)
+	})
+}
 
-	err = trx.Set(table, []string{"key1"}, []byte("value2"))
-	if err != nil {
-		t.Fatal(err)
+func TestMysqlStorageDsn(t *testing.T) {
+	s := &MysqlStorage{
+		Host:     "localhost:3306",
+		Username: "mry_test",
+		Password: "p@ss/w:rd",
+		Database: "mry_test",
 	}
 
-	row, err = trx.Get(table, []string{"key1"})
+	config, err := mysql.ParseDSN(s.dsn())
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if row == nil || string(row.Data) != "value2" {
-		t.Fatalf("Got different value than set: %s!=value2", row)
+	if config.Passwd != s.Password || config.Addr != s.Host || config.DBName != s.Database {
+		t.Fatalf("DSN didn't keep the configuration, got %v", config)
 	}
-
 }
 
-func TestGetSetRollback(t *testing.T) {
-	s := getStorage(t, false)
+func TestMysqlStorageMaxDepth(t *testing.T) {
+	s := getStorage(t, true)
 
 	model := newModel()
-	table := model.CreateTable("getsetrollback")
-	err := s.SyncModel(model)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	trx, err := s.GetTransaction(time.Now())
-	defer trx.Rollback()
-
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = trx.Set(table, []string{"key1"}, []byte("value1"))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	err = trx.Rollback()
-	if err != nil {
-		t.Fatal(err)
+	table := model.CreateTable("maxdepth")
+	for i := 2; i <= 8; i++ {
+		table = table.CreateSubTable("maxdepth" + strconv.Itoa(i))
 	}
 
-	trx, err = s.GetTransaction(time.Now())
-	defer trx.Rollback()
-
-	row, err := trx.Get(table, []string{"key1"})
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if row != nil {
-		t.Fatalf("Row shoulnd't exist after a rollback", row)
+	err := s.SyncModel(model)
+	if err == nil {
+		t.Fatalf("Syncing a model deeper than supported should fail")
 	}
 }
 
-func TestGetSetIsolation(t *testing.T) {
-	s := getStorage(t, false)
+func TestMysqlStorageAlterData(t *testing.T) {
+	s := getStorage(t, true).(*MysqlStorage)
 
 	model := newModel()
-	table := model.CreateTable("getsetisolation")
-	err := s.SyncModel(model)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	trx, err := s.GetTransaction(time.Now())
-	defer trx.Commit()
+	table := model.CreateTable("alterdata")
 
+	// table created before values could exceed 64KB
+	db, err := s.getDb()
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	_, err = db.Exec("CREATE TABLE `alterdata` (`t` bigint(20) NOT NULL, `k1` varchar(128) NOT NULL, `d` blob NOT NULL, PRIMARY KEY (`t`,`k1`)) ENGINE=InnoDB")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	trx.Commit()
-
-	trx, err = s.GetTransaction(time.Now().Add(time.Duration(100000)))
-	defer trx.Commit()
-
+	plan, err := s.PlanMigration(model)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	err = trx.Set(table, []string{"key1"}, []byte("value2"))
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	row, err := trx.Get(table, []string{"key1"})
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if row == nil || string(row.Data) != "value2" {
-		t.Fatalf("Didn't receive expected value: %s!=value2", row)
-	}
-
-	err = trx.Set(table, []string{"key1"}, []byte("value3"))
-	if err != nil {
-		t.Fatal(err)
+	if len(plan.Steps) != 1 || plan.Steps[0].Action != MigrationAlterTable || plan.Destructive() {
+		t.Fatalf("Expected a non destructive alter of the table, got %s", plan)
 	}
 
-	row, err = trx.Get(table, []string{"key1"})
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if row == nil || string(row.Data) != "value3" {
-		t.Fatalf("Didn't receive expected value: %s!=value2", row)
-	}
-}
-
-func TestQuery(t *testing.T) {
-	s := getStorage(t, false)
-
-	model := newModel()
-	table := model.CreateTable("query")
-	err := s.SyncModel(model)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	trx, _ := s.GetTransaction(time.Now())
-	defer trx.Commit()
-	trx.Set(table, []string{"key0"}, []byte("0value1"))
-	trx.Set(table, []string{"key1"}, []byte("1value1"))
-	trx.Set(table, []string{"key2"}, []byte("2value2"))
-	trx.Set(table, []string{"key3"}, []byte("3value1"))
-	trx.Commit()
-
-	trx, _ = s.GetTransaction(time.Now().Add(1))
-	defer trx.Commit()
-	trx.Set(table, []string{"key1"}, []byte("1value2"))
-	trx.Set(table, []string{"key2"}, []byte("2value2"))
-	trx.Commit()
-
-	trx, _ = s.GetTransaction(time.Now().Add(2))
-	defer trx.Commit()
-	trx.Set(table, []string{"key1"}, []byte("1value3"))
-	trx.Commit()
-
-	trx, _ = s.GetTransaction(time.Now().Add(3))
-	defer trx.Commit()
-
-	iter, err := trx.GetQuery(StorageQuery{
-		Table: table,
-	})
+	// syncing the model applies the alter
+	err = s.SyncModel(model)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	for i := 0; i < 2; i++ {
-		row, err := iter.Next()
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		if row != nil {
-			if row.Key1 == "key0" && string(row.Data) != "0value1" {
-				t.Fatalf("Expected 0value1, got %s", row.Data)
-			}
-
-			if row.Key1 == "key1" && string(row.Data) != "1value3" {
-				t.Fatalf("Expected 1value3, got %s", row.Data)
-			}
-
-			if row.Key1 == "key2" && string(row.Data) != "2value2" {
-				t.Fatalf("Expected 2value2, got %s", row.Data)
-			}
-
-			if row.Key1 == "key3" && string(row.Data) != "3value1" {
-				t.Fatalf("Expected 3value1, got %s", row.Data)
-			}
-
-		}
+	plan, _ = s.PlanMigration(model)
+	if !plan.Empty() {
+		t.Fatalf("Expected syncing the model to alter the table, got %s", plan)
 	}
-}
 
-func TestTimeline(t *testing.T) {
-	s := getStorage(t, false)
-
-	model := newModel()
-	table := model.CreateTable("timeline")
-	err := s.SyncModel(model)
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	err = trx.Set(table, []string{"key1"}, make([]byte, 128*1024))
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	trx, _ := s.GetTransaction(time.Now())
-	defer trx.Commit()
-	trx.Set(table, []string{"key0"}, []byte("0value1"))
-	trx.Set(table, []string{"key1"}, []byte("1value1"))
-	trx.Set(table, []string{"key2"}, []byte("2value2"))
-	trx.Set(table, []string{"key3"}, []byte("3value1"))
-	trx.Commit()
-
-	trx, _ = s.GetTransaction(time.Now().Add(1))
-	defer trx.Commit()
-	trx.Set(table, []string{"key1"}, []byte("1value2"))
-	trx.Set(table, []string{"key2"}, []byte("2value2"))
 	trx.Commit()
 
-	trx, _ = s.GetTransaction(time.Now().Add(2))
-	defer trx.Commit()
-	trx.Set(table, []string{"key1"}, []byte("1value3"))
-	trx.Set(table, []string{"key4"}, []byte("4value1"))
-	trx.Commit()
-
-	trx, _ = s.GetTransaction(time.Now().Add(3))
-	defer trx.Commit()
-
-	changes, err := trx.GetTimeline(table, time.Unix(0, 0), 100)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	for _, mut := range changes {
-		sec, first := mut.OldRow, mut.NewRow
-
-		if first.Key1 == "key0" && string(first.Data) == "0value1" && sec.Data != nil {
-			t.Fatalf("Got an 'old' value, expected null: %s - %s", *first, *sec)
-		}
-		if first.Key1 == "key1" && string(first.Data) == "1value2" && string(sec.Data) != "1value1" {
-			t.Fatalf("Got invalid old value, expected 1value1: %s - %s", *first, *sec)
-		}
-		if first.Key1 == "key4" && (string(first.Data) != "4value1" || sec.Data != nil) {
-			t.Fatalf("Got invalid old value, expected 4value1: %s - %s", *first, *sec)
-		}
+	plan, _ = s.PlanMigration(model)
+	if !plan.Empty() {
+		t.Fatalf("Expected no migration once altered, got %s", plan)
 	}
 }
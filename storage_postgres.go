@@ -0,0 +1,157 @@
+package mry
+
+import (
+	"database/sql"
+	_ "github.com/lib/pq"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostgreSQL storage, backed by a database/sql connection pool
+type PostgresStorage struct {
+	sqlStorage
+
+	Host     string
+	Port     int
+	Username string
+	Password string
+	Database string
+
+	// SSL mode of connections, as accepted by lib/pq (disable, require,
+	// verify-ca or verify-full). Connections aren't encrypted if empty,
+	// like a local server expects.
+	SslMode string
+
+	// Pool configuration, zero values use database/sql defaults
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Creates the connection pool
+func (p *PostgresStorage) Init() {
+	p.sqlStorage.init(p)
+}
+
+func (p *PostgresStorage) open() (*sql.DB, error) {
+	db, err := sql.Open("postgres", p.dsn())
+	if err != nil {
+		return nil, err
+	}
+
+	configureSqlPool(db, p.MaxOpenConns, p.MaxIdleConns, p.ConnMaxLifetime)
+	return db, nil
+}
+
+// Data source name. The SSL mode is always given, since lib/pq requires
+// SSL otherwise.
+func (p *PostgresStorage) dsn() string {
+	params := []string{}
+	param := func(name, value string) {
+		if value != "" {
+			value = strings.Replace(value, "\\", "\\\\", -1)
+			value = strings.Replace(value, "'", "\\'", -1)
+			params = append(params, name+"='"+value+"'")
+		}
+	}
+
+	param("host", p.Host)
+	if p.Port > 0 {
+		param("port", strconv.Itoa(p.Port))
+	}
+	param("user", p.Username)
+	param("password", p.Password)
+	param("dbname", p.Database)
+
+	sslMode := p.SslMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	param("sslmode", sslMode)
+
+	return strings.Join(params, " ")
+}
+
+func (p *PostgresStorage) quote(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+// Numbers placeholders, skipping quoted literals and identifiers which may
+// contain a "?"
+func (p *PostgresStorage) rebind(query string) string {
+	ret := make([]byte, 0, len(query))
+	quote := byte(0)
+	count := 0
+
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			// doubled quotes escape a quote, and toggle twice
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			count++
+			ret = append(ret, '$')
+			ret = strconv.AppendInt(ret, int64(count), 10)
+			continue
+		}
+		ret = append(ret, c)
+	}
+
+	return string(ret)
+}
+
+func (p *PostgresStorage) createTable(table string, depth int) []string {
+	sql := "CREATE TABLE " + p.quote(table) + " ("
+	sql = sql + "	t bigint NOT NULL,"
+
+	kList := ""
+	for i := 1; i <= depth; i++ {
+		sql = sql + "	k" + strconv.Itoa(i) + " varchar(128) NOT NULL,"
+		if kList != "" {
+			kList = kList + ","
+		}
+		kList = kList + "k" + strconv.Itoa(i)
+	}
+
+	sql = sql + "	d bytea NOT NULL,"
+	sql = sql + "	PRIMARY KEY (" + kList + ",t)"
+	sql = sql + ")"
+
+	// timeline is iterated by time. Indexes share the namespace of tables, so
+	// the name contains a "/", which separates table paths and can't be part
+	// of a table name.
+	index := "CREATE INDEX " + p.quote(table+"/t_idx") + " ON " + p.quote(table) + " (t)"
+
+	return []string{sql, index}
+}
+
+func (p *PostgresStorage) upsert(table string, depth int) string {
+	keys := strings.Join(sqlKeyColumns("", depth), ",")
+	values := strings.Repeat("?,", depth)
+
+	return "INSERT INTO " + table + " (t," + keys + ",d) VALUES (?," + values + "?) ON CONFLICT (" + keys + ",t) DO UPDATE SET d = EXCLUDED.d"
+}
+
+func (p *PostgresStorage) listTables() string {
+	return "SELECT tablename FROM pg_tables WHERE schemaname = current_schema()"
+}
+
+func (p *PostgresStorage) listColumns() string {
+	return "SELECT table_name, column_name, data_type FROM information_schema.columns WHERE table_schema = current_schema()"
+}
+
+// PostgreSQL indexes have at most 32 columns, including t
+func (p *PostgresStorage) maxDepth() int {
+	return 31
+}
+
+// PostgreSQL bytea data columns have no size limit
+func (p *PostgresStorage) alterData(table string, dataType string) []string {
+	return []string{}
+}
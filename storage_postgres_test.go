@@ -0,0 +1,50 @@
+package mry
+
+import (
+	"strings"
+	"testing"
+)
+
+func getPostgresStorage(t *testing.T) Storage {
+	s := &PostgresStorage{
+		Host:     "localhost",
+		Username: "mry_test",
+		Password: "mry_test",
+		Database: "mry_test",
+		SslMode:  "disable",
+	}
+	s.Init()
+
+	err := s.Nuke()
+	if err != nil {
+		t.Fatalf("Couldn't nuke database: %s", err)
+	}
+
+	return s
+}
+
+func TestPostgresStorage(t *testing.T) {
+	testStorage(t, getPostgresStorage)
+}
+
+func TestPostgresStorageDsn(t *testing.T) {
+	s := &PostgresStorage{Host: "localhost", Database: "mry_test"}
+	if dsn := s.dsn(); !strings.Contains(dsn, "sslmode='disable'") {
+		t.Fatalf("Expected SSL to be disabled by default, got %s", dsn)
+	}
+
+	s.SslMode = "verify-full"
+	if dsn := s.dsn(); !strings.Contains(dsn, "sslmode='verify-full'") {
+		t.Fatalf("Expected configured SSL mode, got %s", dsn)
+	}
+}
+
+func TestPostgresRebind(t *testing.T) {
+	s := &PostgresStorage{}
+
+	query := s.rebind("SELECT d FROM " + s.quote("what?") + " WHERE k1 = ? AND k2 <> 'a?''b' AND t <= ?")
+	expected := `SELECT d FROM "what?" WHERE k1 = $1 AND k2 <> 'a?''b' AND t <= $2`
+	if query != expected {
+		t.Fatalf("Expected %s, got %s", expected, query)
+	}
+}
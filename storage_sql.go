@@ -0,0 +1,893 @@
+package mry
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/appaquet/nrv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Parts of the SQL storage that are specific to a database server.
+// Queries are written with "?" placeholders and passed through rebind.
+type sqlDialect interface {
+	// Opens the connection pool
+	open() (*sql.DB, error)
+
+	// Quotes a table name
+	quote(name string) string
+
+	// Converts "?" placeholders to the server's syntax
+	rebind(query string) string
+
+	// Returns the statements that create a table with the given number
+	// of keys, with columns t, k1..kN and d
+	createTable(table string, depth int) []string
+
+	// Returns the statement inserting a row version (t, k1..kN, d),
+	// replacing its data if the version already exists
+	upsert(table string, depth int) string
+
+	// Returns the query listing the existing tables
+	listTables() string
+
+	// Returns the query listing the columns of the existing tables, as
+	// their table, name and database type
+	listColumns() string
+
+	// Returns the maximum number of keys of a table
+	maxDepth() int
+
+	// Returns the statements altering the data column of a table whose
+	// database type is given, so that it holds values as large as in a
+	// created table. Returns none if the column doesn't need it.
+	alterData(table string, dataType string) []string
+}
+
+// Storage on a SQL database. Each table of the model is stored in its own
+// SQL table with a `t` version column, `k1..kN` key columns and a `d`
+// data column. A new version is inserted on every set.
+type sqlStorage struct {
+	mutex   sync.Mutex
+	dialect sqlDialect
+	db      *sql.DB
+	initErr error
+	stmts   map[sqlStmtKey]*sql.Stmt
+
+	// Number of statements prepared on the pool, cached ones included
+	prepared int
+}
+
+// Identifies a prepared statement in the cache
+type sqlStmtKey struct {
+	table     string
+	operation string
+	depth     int
+}
+
+func (s *sqlStorage) init(dialect sqlDialect) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.db != nil {
+		return
+	}
+
+	s.dialect = dialect
+	s.db, s.initErr = dialect.open()
+	if s.initErr != nil {
+		s.db = nil
+	}
+	s.stmts = make(map[sqlStmtKey]*sql.Stmt)
+}
+
+func (s *sqlStorage) getDb() (*sql.DB, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.initErr != nil {
+		return nil, s.initErr
+	}
+	if s.db == nil {
+		return nil, errors.New("Storage not initialized")
+	}
+	return s.db, nil
+}
+
+// Returns the statement for the given key from the cache, preparing it
+// with the query returned by build if it's not cached yet. Statements
+// are prepared on the pool, database/sql then prepares them once on each
+// connection that executes them.
+func (s *sqlStorage) getStmt(key sqlStmtKey, build func() string) (*sql.Stmt, error) {
+	db, err := s.getDb()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if stmt, found := s.stmts[key]; found {
+		return stmt, nil
+	}
+
+	stmt, err := db.Prepare(s.dialect.rebind(build()))
+	if err != nil {
+		return nil, err
+	}
+
+	s.prepared++
+	s.stmts[key] = stmt
+	return stmt, nil
+}
+
+func (s *sqlStorage) preparedStatements() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.prepared
+}
+
+// Clears cached statements, needed when tables get dropped
+func (s *sqlStorage) clearStmts() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, stmt := range s.stmts {
+		stmt.Close()
+	}
+	s.stmts = make(map[sqlStmtKey]*sql.Stmt)
+}
+
+func (s *sqlStorage) toTableString(table *Table) string {
+	current := table
+	name := ""
+
+	for current != nil {
+		if name != "" {
+			name = "_" + name
+		}
+		name = current.Name + name
+		current = current.parentTable
+	}
+
+	return name
+}
+
+func (s *sqlStorage) GetTransaction(token nrv.Token, trxTime time.Time) (StorageTransaction, error) {
+	db, err := s.getDb()
+	if err != nil {
+		return nil, err
+	}
+
+	// start transaction
+	trx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqlStorageTransaction{
+		trxTime: trxTime,
+		storage: s,
+		trx:     trx,
+		stmts:   make(map[sqlStmtKey]*sql.Stmt),
+	}, nil
+}
+
+func (s *sqlStorage) getTables(db *sql.DB) (map[string]bool, error) {
+	rows, err := db.Query(s.dialect.listTables())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tables := make(map[string]bool)
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			return nil, err
+		}
+
+		tables[table] = true
+	}
+
+	return tables, rows.Err()
+}
+
+func (s *sqlStorage) SyncModel(model *Model) error {
+	_, err := syncModel(s, model)
+	return err
+}
+
+func (s *sqlStorage) PlanMigration(model *Model) (*MigrationPlan, error) {
+	db, err := s.getDb()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stored := range storedTables(model) {
+		if stored.depth > s.dialect.maxDepth() {
+			return nil, errors.New(fmt.Sprintf("Table %s has %d levels of keys, storage supports at most %d", stored.table.Path(), stored.depth, s.dialect.maxDepth()))
+		}
+	}
+
+	schemas, err := s.getTableSchemas(db)
+	if err != nil {
+		return nil, err
+	}
+
+	liveTables := make(map[string]int)
+	for table, schema := range schemas {
+		liveTables[table] = schema.depth
+	}
+	plan := planMigration(model, liveTables, s.toTableString)
+
+	// kept tables whose data column is smaller than in created ones
+	alters := make([]MigrationStep, 0)
+	for _, stored := range storedTables(model) {
+		table := s.toTableString(stored.table)
+		if schema, found := schemas[table]; found && schema.depth == stored.depth {
+			if len(s.dialect.alterData(table, schema.dataType)) > 0 {
+				alters = append(alters, MigrationStep{Action: MigrationAlterTable, Table: table, Depth: stored.depth})
+			}
+		}
+	}
+	sort.Sort(migrationStepsByTable(alters))
+	plan.Steps = append(plan.Steps, alters...)
+
+	return plan, nil
+}
+
+// Schema of an existing table
+type sqlTableSchema struct {
+	depth    int
+	dataType string
+}
+
+// Returns the schema of the existing tables, their number of keys being
+// the number of k columns. Types are read from the catalog of the server,
+// since drivers may report the same type for columns of different sizes.
+func (s *sqlStorage) getTableSchemas(db *sql.DB) (map[string]sqlTableSchema, error) {
+	rows, err := db.Query(s.dialect.listColumns())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	schemas := make(map[string]sqlTableSchema)
+	for rows.Next() {
+		var table, name, dataType string
+		err = rows.Scan(&table, &name, &dataType)
+		if err != nil {
+			return nil, err
+		}
+
+		schema := schemas[table]
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "k") {
+			schema.depth++
+		} else if name == "d" {
+			schema.dataType = strings.ToUpper(dataType)
+		}
+		schemas[table] = schema
+	}
+
+	return schemas, rows.Err()
+}
+
+func (s *sqlStorage) ApplyMigration(plan *MigrationPlan, allowDestructive bool) error {
+	err := plan.check(allowDestructive)
+	if err != nil {
+		return err
+	}
+
+	db, err := s.getDb()
+	if err != nil {
+		return err
+	}
+
+	// cached statements may be on tables that get dropped
+	if plan.Destructive() {
+		s.clearStmts()
+	}
+
+	for _, step := range plan.Steps {
+		if step.Action == MigrationRecreateTable || step.Action == MigrationDropTable {
+			_, err = db.Exec("DROP TABLE " + s.dialect.quote(step.Table))
+			if err != nil {
+				return err
+			}
+		}
+
+		if step.Action == MigrationCreateTable || step.Action == MigrationRecreateTable {
+			err = s.createTable(db, step.Table, step.Depth)
+			if err != nil {
+				return err
+			}
+		}
+
+		if step.Action == MigrationAlterTable {
+			err = s.alterData(db, step.Table)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Alters the data column of a table if it still needs it
+func (s *sqlStorage) alterData(db *sql.DB, table string) error {
+	schemas, err := s.getTableSchemas(db)
+	if err != nil {
+		return err
+	}
+
+	schema, found := schemas[table]
+	if !found {
+		return errors.New(fmt.Sprintf("Table %s doesn't exist", table))
+	}
+
+	for _, query := range s.dialect.alterData(table, schema.dataType) {
+		_, err := db.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) createTable(db *sql.DB, table string, depth int) error {
+	for _, query := range s.dialect.createTable(table, depth) {
+		_, err := db.Exec(query)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) Nuke() error {
+	db, err := s.getDb()
+	if err != nil {
+		return err
+	}
+
+	tables, err := s.getTables(db)
+	if err != nil {
+		return err
+	}
+
+	s.clearStmts()
+
+	for table := range tables {
+		_, err = db.Exec("DROP TABLE " + s.dialect.quote(table))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *sqlStorage) Compact(table *Table, now time.Time, horizon time.Time) error {
+	if !table.Retention.Enabled() {
+		return nil
+	}
+
+	db, err := s.getDb()
+	if err != nil {
+		return err
+	}
+
+	trx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = s.compactTable(trx, table, now, horizon)
+	if err != nil {
+		trx.Rollback()
+		return err
+	}
+
+	return trx.Commit()
+}
+
+func (s *sqlStorage) compactTable(trx *sql.Tx, table *Table, now time.Time, horizon time.Time) error {
+	tableName := s.dialect.quote(s.toTableString(table))
+	depth := table.Depth()
+	keyColumns := strings.Join(sqlKeyColumns("", depth), ", ")
+
+	// versions are sorted by keys, then timestamp, so that the versions
+	// of a row are consecutive
+	rows, err := trx.Query("SELECT " + keyColumns + ", t FROM " + tableName + " ORDER BY " + keyColumns + ", t ASC")
+	if err != nil {
+		return err
+	}
+
+	type cutoff struct {
+		keys      []interface{}
+		timestamp int64
+	}
+	cutoffs := make([]cutoff, 0)
+
+	var rowKeys []string
+	var timestamps []int64
+	flush := func() {
+		count := table.Retention.prunableVersions(timestamps, now, horizon)
+		if count > 0 {
+			keys := make([]interface{}, len(rowKeys))
+			for i, key := range rowKeys {
+				keys[i] = key
+			}
+			cutoffs = append(cutoffs, cutoff{keys, timestamps[count]})
+		}
+	}
+
+	keys := make([]string, depth)
+	var timestamp int64
+	bindings := make([]interface{}, depth+1)
+	for i := range keys {
+		bindings[i] = &keys[i]
+	}
+	bindings[depth] = &timestamp
+
+	for rows.Next() {
+		err = rows.Scan(bindings...)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+
+		if rowKeys == nil || strings.Join(rowKeys, "\x00") != strings.Join(keys, "\x00") {
+			if rowKeys != nil {
+				flush()
+			}
+			rowKeys = append([]string{}, keys...)
+			timestamps = timestamps[:0]
+		}
+		timestamps = append(timestamps, timestamp)
+	}
+	if rowKeys != nil {
+		flush()
+	}
+
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	if len(cutoffs) == 0 {
+		return nil
+	}
+
+	// remove versions older than the cutoff of each row
+	query := "DELETE FROM " + tableName + " WHERE t < ?"
+	for _, column := range sqlKeyColumns("", depth) {
+		query = query + " AND " + column + " = ?"
+	}
+
+	stmt, err := trx.Prepare(s.dialect.rebind(query))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, cutoff := range cutoffs {
+		_, err = stmt.Exec(append([]interface{}{cutoff.timestamp}, cutoff.keys...)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the list of key columns, prefixed by the given table alias
+func sqlKeyColumns(alias string, depth int) []string {
+	columns := make([]string, depth)
+	for i := range columns {
+		columns[i] = alias + "k" + strconv.Itoa(i+1)
+	}
+	return columns
+}
+
+// Returns a condition matching the key columns of two table aliases
+func sqlSameKeys(alias1, alias2 string, depth int) string {
+	cond := ""
+	for i := 1; i <= depth; i++ {
+		cond = cond + " AND " + alias1 + ".k" + strconv.Itoa(i) + " = " + alias2 + ".k" + strconv.Itoa(i)
+	}
+	return cond
+}
+
+type sqlStorageTransaction struct {
+	trxTime time.Time
+	storage *sqlStorage
+	trx     *sql.Tx
+	stmts   map[sqlStmtKey]*sql.Stmt
+}
+
+func (t *sqlStorageTransaction) setTime(trxTime time.Time) {
+	t.trxTime = trxTime
+}
+
+// Returns the cached statement for an operation on a table with the
+// given number of keys, bound to this transaction
+func (t *sqlStorageTransaction) getStmt(table *Table, operation string, depth int, build func(table string) string) (*sql.Stmt, error) {
+	key := sqlStmtKey{t.storage.toTableString(table), operation, depth}
+	if stmt, found := t.stmts[key]; found {
+		return stmt, nil
+	}
+
+	stmt, err := t.storage.getStmt(key, func() string {
+		return build(t.storage.dialect.quote(key.table))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	trxStmt := t.trx.Stmt(stmt)
+	t.stmts[key] = trxStmt
+	return trxStmt, nil
+}
+
+// Returns the scan destinations of the t, k1..kN and d columns into the row
+func (t *sqlStorageTransaction) buildBinding(row *Row, nbKeys int) []interface{} {
+	row.Keys = make([]string, nbKeys)
+
+	bindings := make([]interface{}, 0, nbKeys+2)
+	bindings = append(bindings, &row.IntTimestamp)
+	for i := range row.Keys {
+		bindings = append(bindings, &row.Keys[i])
+	}
+	return append(bindings, &row.Data)
+}
+
+func (t *sqlStorageTransaction) Get(table *Table, keys []string) (*Row, error) {
+	stmt, err := t.getStmt(table, "get", len(keys), func(tableName string) string {
+		projKeys := strings.Join(sqlKeyColumns("", len(keys)), ", ")
+		sqlKeys := strings.Join(sqlKeyColumns("", len(keys)), " = ? AND ") + " = ?"
+
+		return "SELECT t, " + projKeys + ", d FROM " + tableName + " WHERE " + sqlKeys + " AND t <= ? ORDER BY t DESC LIMIT 1"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	iKeys := make([]interface{}, len(keys)+1)
+	for i, key := range keys {
+		iKeys[i] = key
+	}
+	iKeys[len(keys)] = t.trxTime.UnixNano()
+
+	row := &Row{}
+	bindings := t.buildBinding(row, len(keys))
+	err = stmt.QueryRow(iKeys...).Scan(bindings...)
+	if err == sql.ErrNoRows || (err == nil && row.Deleted()) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	row.ConvertTimestamp()
+	return row, nil
+}
+
+// Only the latest version of each row at read time is selected, deleted
+// rows being filtered and the limit applied by the database, so that no
+// more rows than needed are read.
+func (t *sqlStorageTransaction) GetQuery(query StorageQuery) (RowIterator, error) {
+	depth := query.Table.Depth()
+	prefixLen := len(query.TablePrefix)
+
+	conditions := make([]string, 0)
+	args := make([]interface{}, 0)
+	for i, v := range query.TablePrefix {
+		conditions = append(conditions, "cur.k"+strconv.Itoa(i+1)+" = ?")
+		args = append(args, v)
+	}
+
+	// conditions on the key following the prefix, if any
+	if prefixLen < depth {
+		boundColumn := "cur.k" + strconv.Itoa(prefixLen+1)
+		if query.hasStartKey() {
+			if query.StartExclusive {
+				conditions = append(conditions, boundColumn+" > ?")
+			} else {
+				conditions = append(conditions, boundColumn+" >= ?")
+			}
+			args = append(args, query.StartKey)
+		}
+		if query.hasEndKey() {
+			if query.EndExclusive {
+				conditions = append(conditions, boundColumn+" < ?")
+			} else {
+				conditions = append(conditions, boundColumn+" <= ?")
+			}
+			args = append(args, query.EndKey)
+		}
+	}
+
+	// only the latest version visible at read time, unless deleted
+	readTime := readTimeAt(query.Time, t.trxTime).UnixNano()
+	args = append(args, readTime, readTime)
+
+	order := " ASC"
+	if query.Reverse {
+		order = " DESC"
+	}
+
+	limit := ""
+	if query.Limit > 0 {
+		limit = " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	// statements differ by their conditions, order and limit
+	operation := "query " + strings.Join(conditions, " AND ") + order + limit
+
+	stmt, err := t.getStmt(query.Table, operation, prefixLen, func(table string) string {
+		curKeys := strings.Join(sqlKeyColumns("cur.", depth), ", ")
+
+		where := append(append([]string{}, conditions...), "cur.t <= ?")
+
+		sql := "SELECT cur.t, " + curKeys + ", cur.d FROM " + table + " AS cur"
+		sql = sql + " WHERE " + strings.Join(where, " AND ")
+		sql = sql + " AND NOT EXISTS ("
+		sql = sql + "	SELECT 1 FROM " + table + " AS nxt"
+		sql = sql + "	WHERE nxt.t > cur.t AND nxt.t <= ?" + sqlSameKeys("nxt", "cur", depth)
+		sql = sql + " )"
+		sql = sql + " AND LENGTH(cur.d) > 0"
+		sql = sql + " ORDER BY " + strings.Join(sqlKeyColumns("cur.", depth), order+", ") + order
+		sql = sql + limit
+
+		return sql
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator := &sqlRowIterator{row: &Row{}, rows: rows}
+	iterator.bindings = t.buildBinding(iterator.row, depth)
+
+	return iterator, nil
+}
+
+func (t *sqlStorageTransaction) Set(table *Table, keys []string, data []byte) error {
+	if len(data) == 0 {
+		return errors.New("Cannot set a row without data")
+	}
+
+	return t.write(table, keys, data)
+}
+
+func (t *sqlStorageTransaction) Delete(table *Table, keys []string) error {
+	return t.write(table, keys, []byte{})
+}
+
+// Writes a version of the row at transaction time, empty data being a tombstone
+func (t *sqlStorageTransaction) write(table *Table, keys []string, data []byte) error {
+	stmt, err := t.getStmt(table, "set", len(keys), func(tableName string) string {
+		return t.storage.dialect.upsert(tableName, len(keys))
+	})
+	if err != nil {
+		return err
+	}
+
+	iKeys := make([]interface{}, len(keys)+2)
+	iKeys[0] = t.trxTime.UnixNano()
+	for i, key := range keys {
+		iKeys[i+1] = key
+	}
+	iKeys[len(iKeys)-1] = data
+
+	_, err = stmt.Exec(iKeys...)
+	return err
+}
+
+func (t *sqlStorageTransaction) GetTimeline(table *Table, from time.Time, count int) ([]RowMutation, error) {
+	depth := table.Depth()
+	stmt, err := t.getStmt(table, "timeline", depth, func(tableName string) string {
+		curKeys := strings.Join(sqlKeyColumns("cur.", depth), ", ")
+		prvKeys := strings.Join(sqlKeyColumns("prv.", depth), ", ")
+
+		query := ""
+		query = query + "	SELECT cur.t, " + curKeys + ", cur.d, prv.t, " + prvKeys + ", prv.d, NOT EXISTS ("
+		query = query + "		SELECT 1 FROM " + tableName + " AS nxt"
+		query = query + "		WHERE nxt.t > cur.t " + sqlSameKeys("nxt", "cur", depth)
+		query = query + "	)"
+		query = query + "	FROM " + tableName + " AS cur "
+		query = query + "	LEFT JOIN " + tableName + " AS prv ON (prv.t = ("
+		query = query + "		SELECT MAX(alt.t)"
+		query = query + "		FROM " + tableName + " AS alt"
+		query = query + "		WHERE alt.t < cur.t " + sqlSameKeys("alt", "cur", depth)
+		query = query + "	)" + sqlSameKeys("prv", "cur", depth) + ")"
+		query = query + "	WHERE cur.t >= ?"
+		query = query + "	ORDER BY cur.t ASC"
+		query = query + "	LIMIT ?"
+
+		return query
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := stmt.Query(from.UnixNano(), count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// old row is null if it's the first version of the row
+	newRow := &Row{}
+	bindings := t.buildBinding(newRow, depth)
+	oldTimestamp := &sql.NullInt64{}
+	oldKeys := make([]sql.NullString, depth)
+	oldData := []byte{}
+	bindings = append(bindings, oldTimestamp)
+	for i := range oldKeys {
+		bindings = append(bindings, &oldKeys[i])
+	}
+	bindings = append(bindings, &oldData)
+	lastVersion := false
+	bindings = append(bindings, &lastVersion)
+
+	ret := make([]RowMutation, 0)
+	for rows.Next() {
+		err = rows.Scan(bindings...)
+		if err != nil {
+			return nil, err
+		}
+
+		if newRow.Deleted() {
+			newRow.Data = nil
+		}
+
+		oldRow := &Row{}
+		if oldTimestamp.Valid && len(oldData) > 0 {
+			oldRow.IntTimestamp = oldTimestamp.Int64
+			oldRow.Data = oldData
+
+			oldRow.Keys = make([]string, depth)
+			for i, key := range oldKeys {
+				oldRow.Keys[i] = key.String
+			}
+		}
+
+		// convert timestamp form int to time.Time struct
+		oldRow.ConvertTimestamp()
+		newRow.ConvertTimestamp()
+
+		ret = append(ret, RowMutation{
+			OldRow:      oldRow,
+			NewRow:      &Row{newRow.IntTimestamp, newRow.Timestamp, append([]string{}, newRow.Keys...), newRow.Data},
+			LastVersion: lastVersion,
+		})
+
+		newRow.Reset()
+		oldData = nil
+	}
+
+	return ret, rows.Err()
+}
+
+func (t *sqlStorageTransaction) GetHistory(table *Table, keys []string, from time.Time, to time.Time, limit int) ([]*Row, error) {
+	operation := "history"
+	if limit > 0 {
+		operation = "history limit"
+	}
+
+	stmt, err := t.getStmt(table, operation, len(keys), func(tableName string) string {
+		projKeys := strings.Join(sqlKeyColumns("", len(keys)), ", ")
+		sqlKeys := strings.Join(sqlKeyColumns("", len(keys)), " = ? AND ") + " = ?"
+
+		sql := "SELECT t, " + projKeys + ", d FROM " + tableName + " WHERE " + sqlKeys + " AND t >= ? AND t <= ? ORDER BY t DESC"
+		if limit > 0 {
+			sql = sql + " LIMIT ?"
+		}
+		return sql
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]interface{}, 0, len(keys)+3)
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	args = append(args, from.UnixNano(), readTimeAt(to, t.trxTime).UnixNano())
+	if limit > 0 {
+		args = append(args, limit)
+	}
+
+	rows, err := stmt.Query(args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ret := make([]*Row, 0)
+	for rows.Next() {
+		row := &Row{}
+		err = rows.Scan(t.buildBinding(row, len(keys))...)
+		if err != nil {
+			return nil, err
+		}
+
+		if row.Deleted() {
+			row.Data = nil
+		}
+		row.ConvertTimestamp()
+		ret = append(ret, row)
+	}
+
+	return ret, rows.Err()
+}
+
+func (t *sqlStorageTransaction) Rollback() error {
+	return t.trx.Rollback()
+}
+
+func (t *sqlStorageTransaction) Commit() error {
+	return t.trx.Commit()
+}
+
+// RowIterator for SQL storages, streaming the rows selected by the query
+type sqlRowIterator struct {
+	row      *Row
+	bindings []interface{}
+	rows     *sql.Rows
+}
+
+func (i *sqlRowIterator) Next() (*Row, error) {
+	for i.rows.Next() {
+		i.row.Reset()
+		err := i.rows.Scan(i.bindings...)
+		if err != nil {
+			return nil, err
+		}
+
+		// deleted rows are filtered by the query, but stay skipped
+		if i.row.Deleted() {
+			continue
+		}
+
+		i.row.ConvertTimestamp()
+		return i.row, nil
+	}
+
+	return nil, i.rows.Err()
+}
+
+func (i *sqlRowIterator) Close() {
+	_ = i.rows.Close()
+}
+
+// Applies pool configuration, zero values keeping database/sql defaults
+func configureSqlPool(db *sql.DB, maxOpenConns, maxIdleConns int, connMaxLifetime time.Duration) {
+	if maxOpenConns > 0 {
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+	if maxIdleConns > 0 {
+		db.SetMaxIdleConns(maxIdleConns)
+	}
+	if connMaxLifetime > 0 {
+		db.SetConnMaxLifetime(connMaxLifetime)
+	}
+}
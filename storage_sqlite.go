@@ -0,0 +1,82 @@
+package mry
+
+import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
+	"strconv"
+	"strings"
+)
+
+// SQLite storage, stored in a single database file
+type SqliteStorage struct {
+	sqlStorage
+
+	Path string
+}
+
+// Opens the database file
+func (s *SqliteStorage) Init() {
+	s.sqlStorage.init(s)
+}
+
+func (s *SqliteStorage) open() (*sql.DB, error) {
+	return sql.Open("sqlite3", "file:"+s.Path+"?_busy_timeout=5000")
+}
+
+func (s *SqliteStorage) quote(name string) string {
+	return "\"" + strings.Replace(name, "\"", "\"\"", -1) + "\""
+}
+
+func (s *SqliteStorage) rebind(query string) string {
+	return query
+}
+
+func (s *SqliteStorage) createTable(table string, depth int) []string {
+	sql := "CREATE TABLE " + s.quote(table) + " ("
+	sql = sql + "	t INTEGER NOT NULL,"
+
+	kList := ""
+	for i := 1; i <= depth; i++ {
+		sql = sql + "	k" + strconv.Itoa(i) + " TEXT NOT NULL,"
+		if kList != "" {
+			kList = kList + ","
+		}
+		kList = kList + "k" + strconv.Itoa(i)
+	}
+
+	sql = sql + "	d BLOB NOT NULL,"
+	sql = sql + "	PRIMARY KEY (" + kList + ",t)"
+	sql = sql + ")"
+
+	// timeline is iterated by time. Indexes share the namespace of tables, so
+	// the name contains a "/", which separates table paths and can't be part
+	// of a table name.
+	index := "CREATE INDEX " + s.quote(table+"/t_idx") + " ON " + s.quote(table) + " (t)"
+
+	return []string{sql, index}
+}
+
+func (s *SqliteStorage) upsert(table string, depth int) string {
+	keys := strings.Join(sqlKeyColumns("", depth), ",")
+	values := strings.Repeat("?,", depth)
+
+	return "INSERT OR REPLACE INTO " + table + " (t," + keys + ",d) VALUES (?," + values + "?)"
+}
+
+func (s *SqliteStorage) listTables() string {
+	return "SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%'"
+}
+
+func (s *SqliteStorage) listColumns() string {
+	return "SELECT m.name, c.name, c.type FROM sqlite_master AS m JOIN pragma_table_info(m.name) AS c WHERE m.type = 'table' AND m.name NOT LIKE 'sqlite_%'"
+}
+
+// SQLite tables have at most 2000 columns by default, including t and d
+func (s *SqliteStorage) maxDepth() int {
+	return 1998
+}
+
+// SQLite blob data columns have no size limit
+func (s *SqliteStorage) alterData(table string, dataType string) []string {
+	return []string{}
+}
@@ -0,0 +1,27 @@
+package mry
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+)
+
+func TestSqliteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	i := 0
+	testStorage(t, func(t *testing.T) Storage {
+		i++
+		s := &SqliteStorage{
+			Path: path.Join(dir, "mry_test"+strconv.Itoa(i)+".db"),
+		}
+		s.Init()
+		return s
+	})
+}
@@ -0,0 +1,1046 @@
+package mry
+
+import (
+	"github.com/appaquet/nrv"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns an empty storage to run a test against
+type storageFactory func(t *testing.T) Storage
+
+// Runs the storage conformance suite against storages returned by
+// the factory. Every Storage implementation should pass it.
+func testStorage(t *testing.T, factory storageFactory) {
+	scenarios := []struct {
+		name string
+		test func(t *testing.T, s Storage)
+	}{
+		{"GetSet", testStorageGetSet},
+		{"GetSetUnknownTable", testStorageGetSetUnknownTable},
+		{"GetSetRollback", testStorageGetSetRollback},
+		{"GetSetIsolation", testStorageGetSetIsolation},
+		{"GetVersions", testStorageGetVersions},
+		{"Query", testStorageQuery},
+		{"QueryPrefix", testStorageQueryPrefix},
+		{"QueryRange", testStorageQueryRange},
+		{"QueryTime", testStorageQueryTime},
+		{"Timeline", testStorageTimeline},
+		{"History", testStorageHistory},
+		{"Delete", testStorageDelete},
+		{"Compact", testStorageCompact},
+		{"DeepTable", testStorageDeepTable},
+		{"SubTableNamedT", testStorageSubTableNamedT},
+		{"IndexTable", testStorageIndexTable},
+		{"Migration", testStorageMigration},
+		{"StatementCache", testStorageStatementCache},
+	}
+
+	for _, scenario := range scenarios {
+		test := scenario.test
+		t.Run(scenario.name, func(t *testing.T) {
+			test(t, factory(t))
+		})
+	}
+}
+
+// Storage preparing statements, which it should cache
+type statementPreparer interface {
+	preparedStatements() int
+}
+
+func testStorageGetSet(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("getset")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, err := s.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Commit()
+
+	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil || string(row.Data) != "value1" {
+		t.Fatalf("Got different value than set: %v!=value1", row)
+	}
+
+	err = trx.Set(table, []string{"key1"}, []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil || string(row.Data) != "value2" {
+		t.Fatalf("Got different value than set: %v!=value2", row)
+	}
+}
+
+func testStorageGetSetUnknownTable(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("unknown")
+
+	trx, err := s.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Rollback()
+
+	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	if err == nil {
+		t.Fatalf("Expected an error setting into a table that wasn't synced")
+	}
+}
+
+func testStorageGetSetRollback(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("getsetrollback")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, err := s.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, err = s.GetTransaction(nrv.Token(0), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Rollback()
+
+	row, err := trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row != nil {
+		t.Fatalf("Row shouldn't exist after a rollback: %v", row)
+	}
+}
+
+func testStorageGetSetIsolation(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("getsetisolation")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, err := s.GetTransaction(nrv.Token(0), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = trx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, err = s.GetTransaction(nrv.Token(0), now.Add(100000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trx.Commit()
+
+	err = trx.Set(table, []string{"key1"}, []byte("value2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil || string(row.Data) != "value2" {
+		t.Fatalf("Didn't receive expected value: %v!=value2", row)
+	}
+
+	// uncommitted writes are not visible to other transactions
+	other, err := s.GetTransaction(nrv.Token(0), now.Add(200000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = other.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil || string(row.Data) != "value1" {
+		t.Fatalf("Didn't receive expected value: %v!=value1", row)
+	}
+	other.Rollback()
+
+	err = trx.Set(table, []string{"key1"}, []byte("value3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err = trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if row == nil || string(row.Data) != "value3" {
+		t.Fatalf("Didn't receive expected value: %v!=value3", row)
+	}
+}
+
+func testStorageGetVersions(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("getversions")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"key1"}, []byte("value1"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	trx.Set(table, []string{"key1"}, []byte("value2"))
+	trx.Commit()
+
+	// reads are made as of transaction time
+	expected := []struct {
+		time  time.Time
+		value string
+	}{
+		{now.Add(-1), ""},
+		{now, "value1"},
+		{now.Add(1), "value1"},
+		{now.Add(2), "value2"},
+		{now.Add(3), "value2"},
+	}
+
+	for _, exp := range expected {
+		trx, _ = s.GetTransaction(nrv.Token(0), exp.time)
+		row, err := trx.Get(table, []string{"key1"})
+		trx.Rollback()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if exp.value == "" && row != nil {
+			t.Fatalf("Row shouldn't exist before it was set: %v", row)
+		} else if exp.value != "" && (row == nil || string(row.Data) != exp.value) {
+			t.Fatalf("Didn't receive expected value: %v!=%s", row, exp.value)
+		}
+	}
+}
+
+func testStorageHistory(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("history")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"key1"}, []byte("value1"))
+	trx.Set(table, []string{"key2"}, []byte("other"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	trx.Set(table, []string{"key1"}, []byte("value2"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(4))
+	trx.Delete(table, []string{"key1"})
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(6))
+	trx.Set(table, []string{"key1"}, []byte("value3"))
+	trx.Commit()
+
+	expected := []struct {
+		trxTime time.Time
+		from    time.Time
+		to      time.Time
+		limit   int
+		values  []string
+	}{
+		{now.Add(10), time.Time{}, time.Time{}, 0, []string{"value3", "", "value2", "value1"}},
+		{now.Add(10), time.Time{}, time.Time{}, 2, []string{"value3", ""}},
+		{now.Add(10), now.Add(1), now.Add(4), 0, []string{"", "value2"}},
+		{now.Add(3), time.Time{}, time.Time{}, 0, []string{"value2", "value1"}},
+		{now.Add(3), time.Time{}, now.Add(10), 0, []string{"value2", "value1"}},
+		{now.Add(-1), time.Time{}, time.Time{}, 0, []string{}},
+	}
+
+	for _, exp := range expected {
+		trx, _ = s.GetTransaction(nrv.Token(0), exp.trxTime)
+		rows, err := trx.GetHistory(table, []string{"key1"}, exp.from, exp.to, exp.limit)
+		trx.Rollback()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		values := make([]string, len(rows))
+		for i, row := range rows {
+			if row.Keys[0] != "key1" {
+				t.Fatalf("Got a version of another row: %v", row)
+			}
+			values[i] = string(row.Data)
+		}
+
+		if strings.Join(values, ",") != strings.Join(exp.values, ",") || len(values) != len(exp.values) {
+			t.Fatalf("Didn't receive expected versions: %v!=%v", values, exp.values)
+		}
+	}
+}
+
+func testStorageQuery(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("query")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"key0"}, []byte("0value1"))
+	trx.Set(table, []string{"key1"}, []byte("1value1"))
+	trx.Set(table, []string{"key2"}, []byte("2value2"))
+	trx.Set(table, []string{"key3"}, []byte("3value1"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(1))
+	trx.Set(table, []string{"key1"}, []byte("1value2"))
+	trx.Set(table, []string{"key2"}, []byte("2value2"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	trx.Set(table, []string{"key1"}, []byte("1value3"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(3))
+	defer trx.Commit()
+
+	iter, err := trx.GetQuery(StorageQuery{
+		Table: table,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	expected := []string{"0value1", "1value3", "2value2", "3value1"}
+	for i, exp := range expected {
+		key := "key" + strconv.Itoa(i)
+		row, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if row == nil || row.Keys[0] != key || string(row.Data) != exp {
+			t.Fatalf("Expected %s, got %v", exp, row)
+		}
+	}
+
+	row, err := iter.Next()
+	if row != nil || err != nil {
+		t.Fatalf("Expected end of iterator, got %v (%v)", row, err)
+	}
+}
+
+func testStorageQueryPrefix(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("queryprefix").CreateSubTable("sub")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+	trx.Set(table, []string{"parent1", "key1"}, []byte("value1"))
+	trx.Set(table, []string{"parent1", "key2"}, []byte("value2"))
+	trx.Set(table, []string{"parent2", "key1"}, []byte("value3"))
+
+	iter, err := trx.GetQuery(StorageQuery{
+		Table:       table,
+		TablePrefix: []string{"parent1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	expected := []string{"value1", "value2"}
+	for _, exp := range expected {
+		row, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if row == nil || row.Keys[0] != "parent1" || string(row.Data) != exp {
+			t.Fatalf("Expected %s, got %v", exp, row)
+		}
+	}
+
+	row, err := iter.Next()
+	if row != nil || err != nil {
+		t.Fatalf("Expected end of iterator, got %v (%v)", row, err)
+	}
+}
+
+func testStorageTimeline(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("timeline")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"key0"}, []byte("0value1"))
+	trx.Set(table, []string{"key1"}, []byte("1value1"))
+	trx.Set(table, []string{"key2"}, []byte("2value2"))
+	trx.Set(table, []string{"key3"}, []byte("3value1"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(1))
+	trx.Set(table, []string{"key1"}, []byte("1value2"))
+	trx.Set(table, []string{"key2"}, []byte("2value2"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	trx.Set(table, []string{"key1"}, []byte("1value3"))
+	trx.Set(table, []string{"key4"}, []byte("4value1"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(3))
+	defer trx.Commit()
+
+	changes, err := trx.GetTimeline(table, time.Unix(0, 0), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 8 {
+		t.Fatalf("Expected 8 mutations, got %d", len(changes))
+	}
+
+	for i, mut := range changes {
+		sec, first := mut.OldRow, mut.NewRow
+
+		if i > 0 && changes[i-1].NewRow.IntTimestamp > first.IntTimestamp {
+			t.Fatalf("Mutations are not ordered by time")
+		}
+		if first.Keys[0] == "key0" && string(first.Data) == "0value1" && sec.Data != nil {
+			t.Fatalf("Got an 'old' value, expected null: %v - %v", *first, *sec)
+		}
+		if first.Keys[0] == "key1" && string(first.Data) == "1value2" && string(sec.Data) != "1value1" {
+			t.Fatalf("Got invalid old value, expected 1value1: %v - %v", *first, *sec)
+		}
+		if first.Keys[0] == "key1" && mut.LastVersion != (string(first.Data) == "1value3") {
+			t.Fatalf("Got invalid last version flag: %v", mut)
+		}
+		if first.Keys[0] == "key4" && (string(first.Data) != "4value1" || sec.Data != nil) {
+			t.Fatalf("Got invalid old value, expected 4value1: %v - %v", *first, *sec)
+		}
+	}
+
+	changes, err = trx.GetTimeline(table, now.Add(1), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 || changes[0].NewRow.IntTimestamp != now.Add(1).UnixNano() {
+		t.Fatalf("Expected 2 mutations starting at second transaction, got %v", changes)
+	}
+}
+
+func testStorageDelete(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("delete")
+	subTable := table.CreateSubTable("sub")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"key1"}, []byte("value1"))
+	trx.Set(subTable, []string{"key1", "sub1"}, []byte("sub1"))
+	trx.Set(subTable, []string{"key1", "sub2"}, []byte("sub2"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(1))
+	err = trx.Delete(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = trx.Delete(subTable, []string{"key1", "sub1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := trx.Get(table, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row != nil {
+		t.Fatalf("Row should be deleted: %v", row)
+	}
+	trx.Commit()
+
+	// setting empty data would be confused with a deletion
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	err = trx.Set(table, []string{"key2"}, []byte{})
+	trx.Rollback()
+	if err == nil {
+		t.Fatalf("Setting empty data should fail")
+	}
+
+	// row is still visible before the deletion
+	trx, _ = s.GetTransaction(nrv.Token(0), now)
+	row, _ = trx.Get(table, []string{"key1"})
+	trx.Rollback()
+	if row == nil || string(row.Data) != "value1" {
+		t.Fatalf("Row should exist before deletion: %v", row)
+	}
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	defer trx.Commit()
+
+	row, _ = trx.Get(table, []string{"key1"})
+	if row != nil {
+		t.Fatalf("Row should be deleted: %v", row)
+	}
+
+	iter, err := trx.GetQuery(StorageQuery{
+		Table:       subTable,
+		TablePrefix: []string{"key1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows := make([]string, 0)
+	for row, err = iter.Next(); row != nil && err == nil; row, err = iter.Next() {
+		rows = append(rows, row.Keys[1])
+	}
+	iter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0] != "sub2" {
+		t.Fatalf("Query should skip deleted rows, got %v", rows)
+	}
+
+	changes, err := trx.GetTimeline(table, time.Unix(0, 0), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 mutations, got %d", len(changes))
+	}
+
+	deletion := changes[1]
+	if deletion.NewRow.Keys[0] != "key1" || deletion.NewRow.Data != nil || !deletion.NewRow.Deleted() {
+		t.Fatalf("Deletion should have an empty new row: %v", deletion.NewRow)
+	}
+	if string(deletion.OldRow.Data) != "value1" || !deletion.LastVersion {
+		t.Fatalf("Deletion should have the deleted row as old row: %v", deletion)
+	}
+}
+
+func testStorageCompact(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("compact")
+	table.Retention = RetentionPolicy{MaxVersions: 2}
+	aged := model.CreateTable("compactaged")
+	aged.Retention = RetentionPolicy{MaxAge: 2}
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 4; i++ {
+		trx, _ := s.GetTransaction(nrv.Token(0), now.Add(time.Duration(i)))
+		trx.Set(table, []string{"key1"}, []byte("value"+strconv.Itoa(i)))
+		trx.Set(aged, []string{"key1"}, []byte("value"+strconv.Itoa(i)))
+		if i == 0 {
+			trx.Set(table, []string{"key2"}, []byte("value0"))
+			trx.Set(aged, []string{"key2"}, []byte("value0"))
+		}
+		trx.Commit()
+	}
+
+	getAt := func(table *Table, key string, at time.Time) string {
+		trx, _ := s.GetTransaction(nrv.Token(0), at)
+		defer trx.Rollback()
+
+		row, err := trx.Get(table, []string{key})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil {
+			return ""
+		}
+		return string(row.Data)
+	}
+
+	// a feeder still reading from the second version keeps it and the one before
+	err = s.Compact(table, now.Add(3), now.Add(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := getAt(table, "key1", now); val != "value0" {
+		t.Fatalf("Version needed by horizon shouldn't be removed, got %s", val)
+	}
+
+	err = s.Compact(table, now.Add(3), now.Add(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := getAt(table, "key1", now.Add(1)); val != "" {
+		t.Fatalf("Version should have been removed, got %s", val)
+	}
+	if val := getAt(table, "key1", now.Add(2)); val != "value2" {
+		t.Fatalf("Version should have been kept, got %s", val)
+	}
+	if val := getAt(table, "key2", now.Add(3)); val != "value0" {
+		t.Fatalf("Latest version should never be removed, got %s", val)
+	}
+
+	err = s.Compact(aged, now.Add(3), now.Add(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val := getAt(aged, "key1", now.Add(0)); val != "" {
+		t.Fatalf("Version older than max age should have been removed, got %s", val)
+	}
+	if val := getAt(aged, "key1", now.Add(1)); val != "value1" {
+		t.Fatalf("Version within max age should have been kept, got %s", val)
+	}
+	if val := getAt(aged, "key2", now.Add(3)); val != "value0" {
+		t.Fatalf("Latest version should never be removed, got %s", val)
+	}
+}
+
+func testStorageDeepTable(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("deep")
+	for i := 2; i <= 6; i++ {
+		table = table.CreateSubTable("deep" + strconv.Itoa(i))
+	}
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := []string{"k1", "k2", "k3", "k4", "k5", "k6"}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+
+	err = trx.Set(table, keys, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := trx.Get(table, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row == nil || string(row.Data) != "value1" || len(row.Keys) != 6 || row.Keys[5] != "k6" {
+		t.Fatalf("Got different row than set: %v", row)
+	}
+
+	iter, err := trx.GetQuery(StorageQuery{
+		Table:       table,
+		TablePrefix: keys[:5],
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	row, err = iter.Next()
+	iter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row == nil || len(row.Keys) != 6 || row.Keys[5] != "k6" {
+		t.Fatalf("Query didn't return the row: %v", row)
+	}
+
+	changes, err := trx.GetTimeline(table, time.Unix(0, 0), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || len(changes[0].NewRow.Keys) != 6 || changes[0].NewRow.Keys[5] != "k6" {
+		t.Fatalf("Timeline didn't return the mutation: %v", changes)
+	}
+}
+
+// Sub-tables whose names are the one of their parent followed by _t or
+// _t_idx, like the time indexes of some SQL storages
+func testStorageSubTableNamedT(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("named")
+	subTables := []*Table{table.CreateSubTable("t"), table.CreateSubTable("_t_idx")}
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+
+	err = trx.Set(table, []string{"key1"}, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, subTable := range subTables {
+		err = trx.Set(subTable, []string{"key1", "sub1"}, []byte(subTable.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		row, err := trx.Get(subTable, []string{"key1", "sub1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if row == nil || string(row.Data) != subTable.Name {
+			t.Fatalf("Expected row of the sub-table %s, got %v", subTable.Name, row)
+		}
+	}
+}
+
+func testStorageIndexTable(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("indexed").CreateSubTable("sub")
+	index, err := table.CreateIndex("field")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+
+	err = trx.Set(index.Table(), []string{"parent1", "value1", "key1"}, []byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row, err := trx.Get(index.Table(), []string{"parent1", "value1", "key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row == nil {
+		t.Fatalf("Index entry should have been stored")
+	}
+}
+
+func testStorageMigration(t *testing.T, s Storage) {
+	model := newModel()
+	kept := model.CreateTable("kept")
+	model.CreateTable("dropped")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	trx.Set(kept, []string{"key1"}, []byte("value1"))
+	trx.Commit()
+
+	model = newModel()
+	kept = model.CreateTable("kept")
+	recreated := model.CreateTable("recreated")
+
+	plan, err := s.PlanMigration(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 2 || plan.Steps[0].Action != MigrationCreateTable || plan.Steps[1].Action != MigrationDropTable {
+		t.Fatalf("Expected a create and a drop step, got:\n%s", plan)
+	}
+
+	// create the table with a different number of keys than the model
+	err = s.ApplyMigration(&MigrationPlan{Steps: []MigrationStep{
+		{Action: MigrationCreateTable, Table: plan.Steps[0].Table, Depth: 2},
+	}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err = s.PlanMigration(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Steps) != 2 || plan.Steps[0].Action != MigrationRecreateTable || plan.Steps[0].OldDepth != 2 || plan.Steps[0].Depth != 1 || !plan.Destructive() {
+		t.Fatalf("Expected a recreate and a drop step, got:\n%s", plan)
+	}
+
+	if err = s.SyncModel(model); err == nil {
+		t.Fatalf("Sync shouldn't recreate tables")
+	}
+	if err = s.ApplyMigration(plan, false); err == nil {
+		t.Fatalf("Destructive steps shouldn't be applied without opt-in")
+	}
+	if err = s.ApplyMigration(plan, true); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err = s.PlanMigration(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() {
+		t.Fatalf("Expected an empty plan after migration, got:\n%s", plan)
+	}
+
+	trx, _ = s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+
+	row, err := trx.Get(kept, []string{"key1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if row == nil || string(row.Data) != "value1" {
+		t.Fatalf("Data of kept table should be untouched: %v", row)
+	}
+
+	err = trx.Set(recreated, []string{"key1"}, []byte("value1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStorageQueryRange(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("queryrange").CreateSubTable("events")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+	defer trx.Commit()
+
+	for i := 1; i <= 6; i++ {
+		trx.Set(table, []string{"parent1", "event" + strconv.Itoa(i)}, []byte("value"))
+	}
+	trx.Set(table, []string{"parent2", "event1"}, []byte("value"))
+	trx.Delete(table, []string{"parent1", "event5"})
+
+	expected := []struct {
+		query    StorageQuery
+		expected string
+	}{
+		{StorageQuery{}, "event1,event2,event3,event4,event6"},
+		{StorageQuery{StartKey: "event2", EndKey: "event4"}, "event2,event3,event4"},
+		{StorageQuery{StartKey: "event2", StartExclusive: true, EndKey: "event4", EndExclusive: true}, "event3"},
+		{StorageQuery{StartKey: "event3"}, "event3,event4,event6"},
+		{StorageQuery{EndKey: "event2"}, "event1,event2"},
+		{StorageQuery{Limit: 2}, "event1,event2"},
+		{StorageQuery{Reverse: true, Limit: 2}, "event6,event4"},
+		{StorageQuery{Reverse: true, EndKey: "event3", EndExclusive: true}, "event2,event1"},
+	}
+
+	for _, exp := range expected {
+		query := exp.query
+		query.Table = table
+		query.TablePrefix = []string{"parent1"}
+
+		iter, err := trx.GetQuery(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := ""
+		for row, err := iter.Next(); row != nil || err != nil; row, err = iter.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys != "" {
+				keys = keys + ","
+			}
+			keys = keys + row.Keys[1]
+		}
+		iter.Close()
+
+		if keys != exp.expected {
+			t.Fatalf("Query %+v returned %s, expected %s", exp.query, keys, exp.expected)
+		}
+	}
+
+	// an empty key bounds the query if exclusive
+	trx.Set(table, []string{"parent3", ""}, []byte("value"))
+	trx.Set(table, []string{"parent3", "event1"}, []byte("value"))
+	iter, err := trx.GetQuery(StorageQuery{Table: table, TablePrefix: []string{"parent3"}, StartExclusive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer iter.Close()
+
+	row, err := iter.Next()
+	if err != nil || row == nil || row.Keys[1] != "event1" {
+		t.Fatalf("Expected the query to start after the empty key, got %v (%v)", row, err)
+	}
+}
+
+func testStorageQueryTime(t *testing.T, s Storage) {
+	model := newModel()
+	table := model.CreateTable("querytime").CreateSubTable("events")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+
+	trx, _ := s.GetTransaction(nrv.Token(0), now)
+	trx.Set(table, []string{"parent1", "event1"}, []byte("value1"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(1))
+	trx.Set(table, []string{"parent1", "event1"}, []byte("value2"))
+	trx.Set(table, []string{"parent1", "event2"}, []byte("value1"))
+	trx.Commit()
+
+	// written after the reading transaction, so never visible to it
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(3))
+	trx.Set(table, []string{"parent1", "event1"}, []byte("value3"))
+	trx.Commit()
+
+	trx, _ = s.GetTransaction(nrv.Token(0), now.Add(2))
+	defer trx.Commit()
+
+	expected := []struct {
+		time     time.Time
+		expected string
+	}{
+		{time.Time{}, "event1=value2,event2=value1"},
+		{now, "event1=value1"},
+		{now.Add(-1), ""},
+		{now.Add(3), "event1=value2,event2=value1"},
+	}
+
+	for _, exp := range expected {
+		iter, err := trx.GetQuery(StorageQuery{
+			Table:       table,
+			TablePrefix: []string{"parent1"},
+			Time:        exp.time,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows := ""
+		for row, err := iter.Next(); row != nil || err != nil; row, err = iter.Next() {
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rows != "" {
+				rows = rows + ","
+			}
+			rows = rows + row.Keys[1] + "=" + string(row.Data)
+		}
+		iter.Close()
+
+		if rows != exp.expected {
+			t.Fatalf("Query as of %s returned %s, expected %s", exp.time, rows, exp.expected)
+		}
+	}
+}
+
+func testStorageStatementCache(t *testing.T, s Storage) {
+	preparer, ok := s.(statementPreparer)
+	if !ok {
+		t.Skip("Storage doesn't prepare statements")
+	}
+
+	model := newModel()
+	table := model.CreateTable("stmtcache")
+	err := s.SyncModel(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepared := -1
+	for i := 0; i < 2; i++ {
+		trx, _ := s.GetTransaction(nrv.Token(0), time.Now())
+		for j := 0; j < 2; j++ {
+			err = trx.Set(table, []string{"key1"}, []byte("value1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = trx.Get(table, []string{"key1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		trx.Commit()
+
+		// statements of the first transaction are reused by the next one
+		if prepared >= 0 && preparer.preparedStatements() != prepared {
+			t.Fatalf("Expected no statement to be prepared again, got %d instead of %d", preparer.preparedStatements(), prepared)
+		}
+		prepared = preparer.preparedStatements()
+	}
+}
@@ -13,6 +13,7 @@ var _ = math.Inf
 type Transaction struct {
 	Id               *uint64             `protobuf:"varint,1,opt,name=id" json:"id,omitempty"`
 	Return           *TransactionReturn  `protobuf:"bytes,2,opt,name=return" json:"return,omitempty"`
+	ReadTime         *int64              `protobuf:"varint,3,opt,name=read_time" json:"read_time,omitempty"`
 	Blocks           []*TransactionBlock `protobuf:"bytes,10,rep,name=blocks" json:"blocks,omitempty"`
 	XXX_unrecognized []byte              `json:",omitempty"`
 }
@@ -99,12 +100,91 @@ type TransactionObject struct {
 func (this *TransactionObject) Reset()         { *this = TransactionObject{} }
 func (this *TransactionObject) String() string { return proto.CompactTextString(this) }
 
+type TransactionPredicate_Operator int32
+
+const (
+	TransactionPredicate_EQ  TransactionPredicate_Operator = 1
+	TransactionPredicate_NE  TransactionPredicate_Operator = 2
+	TransactionPredicate_LT  TransactionPredicate_Operator = 3
+	TransactionPredicate_LTE TransactionPredicate_Operator = 4
+	TransactionPredicate_GT  TransactionPredicate_Operator = 5
+	TransactionPredicate_GTE TransactionPredicate_Operator = 6
+	TransactionPredicate_IN  TransactionPredicate_Operator = 7
+	TransactionPredicate_AND TransactionPredicate_Operator = 8
+	TransactionPredicate_OR  TransactionPredicate_Operator = 9
+	TransactionPredicate_NOT TransactionPredicate_Operator = 10
+)
+
+var TransactionPredicate_Operator_name = map[int32]string{
+	1:  "EQ",
+	2:  "NE",
+	3:  "LT",
+	4:  "LTE",
+	5:  "GT",
+	6:  "GTE",
+	7:  "IN",
+	8:  "AND",
+	9:  "OR",
+	10: "NOT",
+}
+var TransactionPredicate_Operator_value = map[string]int32{
+	"EQ":  1,
+	"NE":  2,
+	"LT":  3,
+	"LTE": 4,
+	"GT":  5,
+	"GTE": 6,
+	"IN":  7,
+	"AND": 8,
+	"OR":  9,
+	"NOT": 10,
+}
+
+func (x TransactionPredicate_Operator) Enum() *TransactionPredicate_Operator {
+	p := new(TransactionPredicate_Operator)
+	*p = x
+	return p
+}
+func (x TransactionPredicate_Operator) String() string {
+	return proto.EnumName(TransactionPredicate_Operator_name, int32(x))
+}
+
+type TransactionPredicate struct {
+	Operator         *TransactionPredicate_Operator `protobuf:"varint,1,req,name=operator,enum=mry.TransactionPredicate_Operator" json:"operator,omitempty"`
+	Field            *string                        `protobuf:"bytes,2,opt,name=field" json:"field,omitempty"`
+	Values           []*TransactionObject           `protobuf:"bytes,3,rep,name=values" json:"values,omitempty"`
+	Operands         []*TransactionPredicate        `protobuf:"bytes,4,rep,name=operands" json:"operands,omitempty"`
+	Subject          *TransactionObject             `protobuf:"bytes,5,opt,name=subject" json:"subject,omitempty"`
+	XXX_unrecognized []byte                         `json:",omitempty"`
+}
+
+func (this *TransactionPredicate) Reset()         { *this = TransactionPredicate{} }
+func (this *TransactionPredicate) String() string { return proto.CompactTextString(this) }
+
+type TransactionOrdering struct {
+	Field            *string `protobuf:"bytes,1,req,name=field" json:"field,omitempty"`
+	Descending       *bool   `protobuf:"varint,2,opt,name=descending" json:"descending,omitempty"`
+	XXX_unrecognized []byte  `json:",omitempty"`
+}
+
+func (this *TransactionOrdering) Reset()         { *this = TransactionOrdering{} }
+func (this *TransactionOrdering) String() string { return proto.CompactTextString(this) }
+
 type TransactionOperation struct {
 	Set              *TransactionOperation_Set      `protobuf:"group,1,opt" json:"set,omitempty"`
 	Get              *TransactionOperation_Get      `protobuf:"group,2,opt" json:"get,omitempty"`
 	GetTable         *TransactionOperation_GetTable `protobuf:"group,3,opt,name=Get_table" json:"get_table,omitempty"`
 	Return           *TransactionOperation_Return   `protobuf:"group,4,opt" json:"return,omitempty"`
 	Getall           *TransactionOperation_GetAll   `protobuf:"group,5,opt,name=GetAll" json:"getall,omitempty"`
+	Delete           *TransactionOperation_Delete   `protobuf:"group,6,opt" json:"delete,omitempty"`
+	Lookup           *TransactionOperation_Lookup   `protobuf:"group,7,opt" json:"lookup,omitempty"`
+	Query            *TransactionOperation_Query    `protobuf:"group,8,opt" json:"query,omitempty"`
+	History          *TransactionOperation_History  `protobuf:"group,9,opt" json:"history,omitempty"`
+	Filter           *TransactionOperation_Filter   `protobuf:"group,10,opt" json:"filter,omitempty"`
+	Order            *TransactionOperation_Order    `protobuf:"group,11,opt" json:"order,omitempty"`
+	Limit            *TransactionOperation_Limit    `protobuf:"group,12,opt" json:"limit,omitempty"`
+	If               *TransactionOperation_If       `protobuf:"group,13,opt" json:"if,omitempty"`
+	ForEach          *TransactionOperation_ForEach  `protobuf:"group,14,opt" json:"foreach,omitempty"`
 	XXX_unrecognized []byte                         `json:",omitempty"`
 }
 
@@ -115,6 +195,7 @@ type TransactionOperation_Set struct {
 	Destination      *TransactionVariable `protobuf:"bytes,1,req,name=destination" json:"destination,omitempty"`
 	Key              *TransactionObject   `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
 	Value            *TransactionObject   `protobuf:"bytes,3,req,name=value" json:"value,omitempty"`
+	Ttl              *int64               `protobuf:"varint,4,opt,name=ttl" json:"ttl,omitempty"`
 	XXX_unrecognized []byte               `json:",omitempty"`
 }
 
@@ -150,13 +231,126 @@ func (this *TransactionOperation_Return) Reset()         { *this = TransactionOp
 func (this *TransactionOperation_Return) String() string { return proto.CompactTextString(this) }
 
 type TransactionOperation_GetAll struct {
+	Source            *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Destination       *TransactionVariable `protobuf:"bytes,2,req,name=destination" json:"destination,omitempty"`
+	PageSize          *uint32              `protobuf:"varint,3,opt,name=page_size" json:"page_size,omitempty"`
+	Cursor            *TransactionObject   `protobuf:"bytes,4,opt,name=cursor" json:"cursor,omitempty"`
+	CursorDestination *TransactionVariable `protobuf:"bytes,5,opt,name=cursor_destination" json:"cursor_destination,omitempty"`
+	XXX_unrecognized  []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_GetAll) Reset()         { *this = TransactionOperation_GetAll{} }
+func (this *TransactionOperation_GetAll) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Delete struct {
+	Destination      *TransactionVariable `protobuf:"bytes,1,req,name=destination" json:"destination,omitempty"`
+	Key              *TransactionObject   `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
+	XXX_unrecognized []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_Delete) Reset()         { *this = TransactionOperation_Delete{} }
+func (this *TransactionOperation_Delete) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Lookup struct {
+	Source           *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Field            *TransactionObject   `protobuf:"bytes,2,req,name=field" json:"field,omitempty"`
+	Value            *TransactionObject   `protobuf:"bytes,3,req,name=value" json:"value,omitempty"`
+	Destination      *TransactionVariable `protobuf:"bytes,4,req,name=destination" json:"destination,omitempty"`
+	XXX_unrecognized []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_Lookup) Reset()         { *this = TransactionOperation_Lookup{} }
+func (this *TransactionOperation_Lookup) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Query struct {
 	Source           *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
 	Destination      *TransactionVariable `protobuf:"bytes,2,req,name=destination" json:"destination,omitempty"`
+	StartKey         *TransactionObject   `protobuf:"bytes,3,opt,name=start_key" json:"start_key,omitempty"`
+	StartExclusive   *bool                `protobuf:"varint,4,opt,name=start_exclusive" json:"start_exclusive,omitempty"`
+	EndKey           *TransactionObject   `protobuf:"bytes,5,opt,name=end_key" json:"end_key,omitempty"`
+	EndExclusive     *bool                `protobuf:"varint,6,opt,name=end_exclusive" json:"end_exclusive,omitempty"`
+	Reverse          *bool                `protobuf:"varint,7,opt,name=reverse" json:"reverse,omitempty"`
+	Limit            *uint32              `protobuf:"varint,8,opt,name=limit" json:"limit,omitempty"`
 	XXX_unrecognized []byte               `json:",omitempty"`
 }
 
-func (this *TransactionOperation_GetAll) Reset()         { *this = TransactionOperation_GetAll{} }
-func (this *TransactionOperation_GetAll) String() string { return proto.CompactTextString(this) }
+func (this *TransactionOperation_Query) Reset()         { *this = TransactionOperation_Query{} }
+func (this *TransactionOperation_Query) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_History struct {
+	Source           *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Key              *TransactionObject   `protobuf:"bytes,2,req,name=key" json:"key,omitempty"`
+	Destination      *TransactionVariable `protobuf:"bytes,3,req,name=destination" json:"destination,omitempty"`
+	From             *int64               `protobuf:"varint,4,opt,name=from" json:"from,omitempty"`
+	To               *int64               `protobuf:"varint,5,opt,name=to" json:"to,omitempty"`
+	Limit            *uint32              `protobuf:"varint,6,opt,name=limit" json:"limit,omitempty"`
+	XXX_unrecognized []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_History) Reset()         { *this = TransactionOperation_History{} }
+func (this *TransactionOperation_History) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Filter struct {
+	Source           *TransactionVariable  `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Destination      *TransactionVariable  `protobuf:"bytes,2,req,name=destination" json:"destination,omitempty"`
+	Predicate        *TransactionPredicate `protobuf:"bytes,3,req,name=predicate" json:"predicate,omitempty"`
+	XXX_unrecognized []byte                `json:",omitempty"`
+}
+
+func (this *TransactionOperation_Filter) Reset()         { *this = TransactionOperation_Filter{} }
+func (this *TransactionOperation_Filter) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Order struct {
+	Source           *TransactionVariable   `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Destination      *TransactionVariable   `protobuf:"bytes,2,req,name=destination" json:"destination,omitempty"`
+	Orderings        []*TransactionOrdering `protobuf:"bytes,3,rep,name=orderings" json:"orderings,omitempty"`
+	XXX_unrecognized []byte                 `json:",omitempty"`
+}
+
+func (this *TransactionOperation_Order) Reset()         { *this = TransactionOperation_Order{} }
+func (this *TransactionOperation_Order) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_Limit struct {
+	Source           *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Destination      *TransactionVariable `protobuf:"bytes,2,req,name=destination" json:"destination,omitempty"`
+	Count            *TransactionObject   `protobuf:"bytes,3,req,name=count" json:"count,omitempty"`
+	XXX_unrecognized []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_Limit) Reset()         { *this = TransactionOperation_Limit{} }
+func (this *TransactionOperation_Limit) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_If struct {
+	Condition        *TransactionPredicate `protobuf:"bytes,1,req,name=condition" json:"condition,omitempty"`
+	ThenBlock        *uint32               `protobuf:"varint,2,opt,name=then_block" json:"then_block,omitempty"`
+	ElseBlock        *uint32               `protobuf:"varint,3,opt,name=else_block" json:"else_block,omitempty"`
+	XXX_unrecognized []byte                `json:",omitempty"`
+}
+
+func (this *TransactionOperation_If) Reset()         { *this = TransactionOperation_If{} }
+func (this *TransactionOperation_If) String() string { return proto.CompactTextString(this) }
+
+type TransactionOperation_ForEach struct {
+	Source           *TransactionVariable `protobuf:"bytes,1,req,name=source" json:"source,omitempty"`
+	Item             *TransactionVariable `protobuf:"bytes,2,req,name=item" json:"item,omitempty"`
+	Body             *uint32              `protobuf:"varint,3,req,name=body" json:"body,omitempty"`
+	Destination      *TransactionVariable `protobuf:"bytes,4,req,name=destination" json:"destination,omitempty"`
+	XXX_unrecognized []byte               `json:",omitempty"`
+}
+
+func (this *TransactionOperation_ForEach) Reset()         { *this = TransactionOperation_ForEach{} }
+func (this *TransactionOperation_ForEach) String() string { return proto.CompactTextString(this) }
+
+type TransactionCursor struct {
+	Table            *string  `protobuf:"bytes,1,req,name=table" json:"table,omitempty"`
+	Prefix           []string `protobuf:"bytes,2,rep,name=prefix" json:"prefix,omitempty"`
+	Time             *int64   `protobuf:"varint,3,req,name=time" json:"time,omitempty"`
+	LastKey          *string  `protobuf:"bytes,4,req,name=last_key" json:"last_key,omitempty"`
+	XXX_unrecognized []byte   `json:",omitempty"`
+}
+
+func (this *TransactionCursor) Reset()         { *this = TransactionCursor{} }
+func (this *TransactionCursor) String() string { return proto.CompactTextString(this) }
 
 type JobRow struct {
 	Timestamp        *uint64           `protobuf:"varint,1,req,name=timestamp" json:"timestamp,omitempty"`
@@ -165,6 +359,8 @@ type JobRow struct {
 	Key2             *string           `protobuf:"bytes,4,opt,name=key2" json:"key2,omitempty"`
 	Key3             *string           `protobuf:"bytes,5,opt,name=key3" json:"key3,omitempty"`
 	Key4             *string           `protobuf:"bytes,6,opt,name=key4" json:"key4,omitempty"`
+	Deleted          *bool             `protobuf:"varint,7,opt,name=deleted" json:"deleted,omitempty"`
+	Keys             []string          `protobuf:"bytes,8,rep,name=keys" json:"keys,omitempty"`
 	XXX_unrecognized []byte            `json:",omitempty"`
 }
 
@@ -180,5 +376,17 @@ type JobRowMutation struct {
 func (this *JobRowMutation) Reset()         { *this = JobRowMutation{} }
 func (this *JobRowMutation) String() string { return proto.CompactTextString(this) }
 
+type DumpRow struct {
+	Table            *string  `protobuf:"bytes,1,req,name=table" json:"table,omitempty"`
+	Keys             []string `protobuf:"bytes,2,rep,name=keys" json:"keys,omitempty"`
+	Timestamp        *int64   `protobuf:"varint,3,req,name=timestamp" json:"timestamp,omitempty"`
+	Data             []byte   `protobuf:"bytes,4,opt,name=data" json:"data,omitempty"`
+	XXX_unrecognized []byte   `json:",omitempty"`
+}
+
+func (this *DumpRow) Reset()         { *this = DumpRow{} }
+func (this *DumpRow) String() string { return proto.CompactTextString(this) }
+
 func init() {
+	proto.RegisterEnum("mry.TransactionPredicate_Operator", TransactionPredicate_Operator_name, TransactionPredicate_Operator_value)
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 
 	"reflect"
+	"time"
 )
 
 // Interface of an object that can be handled as a transaction
@@ -17,6 +18,13 @@ type Block interface {
 	From(name string) BlockVariable
 	Into(name string) BlockVariable
 	Return(data ...interface{}) BlockVariable
+	If(condition *TransactionPredicate) Conditional
+}
+
+// Blocks run by an If depending on its condition
+type Conditional interface {
+	Then(cb func(b Block)) Conditional
+	Else(cb func(b Block)) Conditional
 }
 
 type Return interface {
@@ -28,10 +36,29 @@ type BlockVariable interface {
 	Rel(tableName string) BlockVariable
 	Get(key interface{}) BlockVariable
 	Set(key interface{}, val interface{}) BlockVariable
+	SetTTL(key interface{}, val interface{}, ttl time.Duration) BlockVariable
+	Delete(key interface{}) BlockVariable
 	Return() BlockVariable
-	Filter(something interface{}) BlockVariable
-	Order(something interface{}) BlockVariable
+	Filter(predicate *TransactionPredicate) BlockVariable
+	Order(orderings ...*TransactionOrdering) BlockVariable
+	Limit(count interface{}) BlockVariable
 	GetAll() BlockVariable
+	GetPage(pageSize int, cursor interface{}) (rows BlockVariable, nextCursor BlockVariable)
+	Lookup(field string, value interface{}) BlockVariable
+	Query(options QueryOptions) BlockVariable
+	History(key interface{}, from time.Time, to time.Time, limit int) BlockVariable
+	ForEach(body func(b Block, item BlockVariable)) BlockVariable
+}
+
+// Options of a query on the rows of a table. Bounds apply to the keys of
+// the rows and are ignored if nil. A zero limit returns every row.
+type QueryOptions struct {
+	StartKey       interface{}
+	StartExclusive bool
+	EndKey         interface{}
+	EndExclusive   bool
+	Reverse        bool
+	Limit          int
 }
 
 // Transaction that encapsulates operations that will be executed on 
@@ -48,6 +75,25 @@ func (trx *Transaction) GetTransaction() *Transaction {
 	return trx
 }
 
+// Makes the transaction read rows as they were at the given time. The
+// transaction is then read-only, any write fails it.
+func (trx *Transaction) AsOf(readTime time.Time) *Transaction {
+	trx.ReadTime = pb.Int64(readTime.UnixNano())
+	return trx
+}
+
+func (trx *Transaction) readOnly() bool {
+	return trx.ReadTime != nil
+}
+
+// Time at which rows are read by the transaction
+func (trx *Transaction) readTime() time.Time {
+	if trx.ReadTime != nil {
+		return time.Unix(0, *trx.ReadTime)
+	}
+	return time.Unix(0, int64(*trx.Id))
+}
+
 func (trx *Transaction) newBlock() *TransactionBlock {
 	id := len(trx.Blocks)
 	b := &TransactionBlock{
@@ -79,30 +125,82 @@ func (trx *Transaction) execute(context *transactionContext) {
 	mainBlock.execute(context)
 }
 
-func (b *TransactionBlock) execute(context *transactionContext) {
+// Returns the block with the given id, or nil if there's none
+func (trx *Transaction) getBlock(id uint32) *TransactionBlock {
+	for _, block := range trx.Blocks {
+		if *block.Id == id {
+			return block
+		}
+	}
+	return nil
+}
+
+// Executes the operations of the block, returning true if the transaction
+// stopped, by a return or an error
+func (b *TransactionBlock) execute(context *transactionContext) (stop bool) {
+	parent := context.block
+	context.block = b
+	defer func() {
+		context.block = parent
+	}()
+
 	for _, op := range b.Operations {
 		stop := op.execute(context)
 		if stop || context.ret.Error != nil {
-			return
+			return true
 		}
 	}
+	return false
+}
+
+// Builds the blocks of a transaction. Operations are added to the innermost
+// block being built, so that variables of a block can be used by its child
+// blocks.
+type blockBuilder struct {
+	trx   *Transaction
+	stack []*TransactionBlock
+}
+
+func newBlockBuilder(trx *Transaction) *blockBuilder {
+	return &blockBuilder{
+		trx:   trx,
+		stack: []*TransactionBlock{trx.newBlock()},
+	}
+}
+
+func (b *blockBuilder) current() *TransactionBlock {
+	return b.stack[len(b.stack)-1]
 }
 
-func (b *TransactionBlock) newClientVariable() *clientVar {
-	id := len(b.Variables)
+// Builds a child block of the current block with the callback
+func (b *blockBuilder) buildChild(cb func(b Block)) *TransactionBlock {
+	child := b.trx.newBlock()
+	child.Parent = &TransactionBlock{Id: b.current().Id}
+
+	b.stack = append(b.stack, child)
+	cb(b)
+	b.stack = b.stack[:len(b.stack)-1]
+
+	return child
+}
+
+func (b *blockBuilder) newClientVariable() *clientVar {
+	block := b.current()
+	id := len(block.Variables)
 	v := &TransactionVariable{
 		Id:    pb.Uint32(uint32(id)),
-		Block: b.Id,
+		Block: block.Id,
 	}
-	b.Variables = append(b.Variables, v)
-	return &clientVar{block: b, variable: v}
+	block.Variables = append(block.Variables, v)
+	return &clientVar{builder: b, variable: v}
 }
 
-func (b *TransactionBlock) addOperation(op *TransactionOperation) {
-	b.Operations = append(b.Operations, op)
+func (b *blockBuilder) addOperation(op *TransactionOperation) {
+	block := b.current()
+	block.Operations = append(block.Operations, op)
 }
 
-func (b *TransactionBlock) From(name string) BlockVariable {
+func (b *blockBuilder) From(name string) BlockVariable {
 	nv := b.newClientVariable()
 	b.addOperation(&TransactionOperation{
 		GetTable: &TransactionOperation_GetTable{
@@ -113,11 +211,11 @@ func (b *TransactionBlock) From(name string) BlockVariable {
 	return nv
 }
 
-func (b *TransactionBlock) Into(name string) BlockVariable {
+func (b *blockBuilder) Into(name string) BlockVariable {
 	return b.From(name)
 }
 
-func (b *TransactionBlock) Return(data ...interface{}) BlockVariable {
+func (b *blockBuilder) Return(data ...interface{}) BlockVariable {
 	nv := b.newClientVariable()
 
 	objData := make([]*TransactionObject, len(data))
@@ -133,16 +231,41 @@ func (b *TransactionBlock) Return(data ...interface{}) BlockVariable {
 	return nv
 }
 
+// Runs the blocks given to Then or Else depending on the condition, a
+// predicate on variables built with On or Exists
+func (b *blockBuilder) If(condition *TransactionPredicate) Conditional {
+	op := &TransactionOperation_If{
+		Condition: condition,
+	}
+	b.addOperation(&TransactionOperation{If: op})
+	return &clientConditional{builder: b, op: op}
+}
+
+// Conditional operation being built
+type clientConditional struct {
+	builder *blockBuilder
+	op      *TransactionOperation_If
+}
+
+func (c *clientConditional) Then(cb func(b Block)) Conditional {
+	c.op.ThenBlock = c.builder.buildChild(cb).Id
+	return c
+}
+
+func (c *clientConditional) Else(cb func(b Block)) Conditional {
+	c.op.ElseBlock = c.builder.buildChild(cb).Id
+	return c
+}
+
 // Wrapped transaction variable to support operations 
 // that will be stacked on the current block
 type clientVar struct {
-	block    *TransactionBlock
+	builder  *blockBuilder
 	variable *TransactionVariable
 }
 
-func (v *clientVar) getBlock() *TransactionBlock {
-	// TODO: should return last stacked block (for recursive block)
-	return v.block
+func (v *clientVar) getBlock() *blockBuilder {
+	return v.builder
 }
 
 func (v *clientVar) Rel(tableName string) BlockVariable {
@@ -185,6 +308,34 @@ func (v *clientVar) Set(key interface{}, val interface{}) BlockVariable {
 	return nv
 }
 
+// Sets a row that expires after the given time to live. Expired rows aren't
+// read anymore, and get deleted by the database's expiry sweeper.
+func (v *clientVar) SetTTL(key interface{}, val interface{}, ttl time.Duration) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Set: &TransactionOperation_Set{
+			Destination: v.variable,
+			Key:         toObject(key),
+			Value:       toObject(val),
+			Ttl:         pb.Int64(int64(ttl)),
+		},
+	})
+	return nv
+}
+
+func (v *clientVar) Delete(key interface{}) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Delete: &TransactionOperation_Delete{
+			Destination: v.variable,
+			Key:         toObject(key),
+		},
+	})
+	return nv
+}
+
 func (v *clientVar) Return() BlockVariable {
 	b := v.getBlock()
 	nv := b.newClientVariable()
@@ -196,15 +347,48 @@ func (v *clientVar) Return() BlockVariable {
 	return nv
 }
 
-func (v *clientVar) Filter(something interface{}) BlockVariable {
-	nv := v.getBlock().newClientVariable()
-	// TODO: implement
+// Returns the rows or maps of the variable matching the predicate. On a
+// table or query, rows are filtered as they are read, GetAll then returning
+// the matching ones.
+func (v *clientVar) Filter(predicate *TransactionPredicate) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Filter: &TransactionOperation_Filter{
+			Source:      v.variable,
+			Destination: nv.variable,
+			Predicate:   predicate,
+		},
+	})
 	return nv
 }
 
-func (v *clientVar) Order(something interface{}) BlockVariable {
-	nv := v.getBlock().newClientVariable()
-	// TODO: implement
+// Returns the array sorted by the orderings, built with Asc and Desc, the
+// first one prevailing
+func (v *clientVar) Order(orderings ...*TransactionOrdering) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Order: &TransactionOperation_Order{
+			Source:      v.variable,
+			Destination: nv.variable,
+			Orderings:   orderings,
+		},
+	})
+	return nv
+}
+
+// Returns the first values of the array
+func (v *clientVar) Limit(count interface{}) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Limit: &TransactionOperation_Limit{
+			Source:      v.variable,
+			Destination: nv.variable,
+			Count:       toObject(count),
+		},
+	})
 	return nv
 }
 
@@ -220,6 +404,113 @@ func (v *clientVar) GetAll() BlockVariable {
 	return nv
 }
 
+// Returns a page of rows, starting after the cursor returned by a previous
+// page or at the beginning if it's nil. The next cursor is nil once all
+// rows have been returned.
+func (v *clientVar) GetPage(pageSize int, cursor interface{}) (rows BlockVariable, nextCursor BlockVariable) {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	cv := b.newClientVariable()
+
+	op := &TransactionOperation_GetAll{
+		Destination:       nv.variable,
+		Source:            v.variable,
+		PageSize:          pb.Uint32(uint32(pageSize)),
+		CursorDestination: cv.variable,
+	}
+	if cursor != nil {
+		op.Cursor = toObject(cursor)
+	}
+
+	b.addOperation(&TransactionOperation{Getall: op})
+	return nv, cv
+}
+
+// Returns a query on the rows of the table, executed by GetAll
+func (v *clientVar) Query(options QueryOptions) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+
+	op := &TransactionOperation_Query{
+		Source:         v.variable,
+		Destination:    nv.variable,
+		StartExclusive: pb.Bool(options.StartExclusive),
+		EndExclusive:   pb.Bool(options.EndExclusive),
+		Reverse:        pb.Bool(options.Reverse),
+		Limit:          pb.Uint32(uint32(options.Limit)),
+	}
+	if options.StartKey != nil {
+		op.StartKey = toObject(options.StartKey)
+	}
+	if options.EndKey != nil {
+		op.EndKey = toObject(options.EndKey)
+	}
+
+	b.addOperation(&TransactionOperation{Query: op})
+	return nv
+}
+
+// Returns the versions of a row written between from and to, newest first,
+// each with its _timestamp. Deleted versions only have their _timestamp and
+// _deleted set. Zero times and limit are unbounded.
+func (v *clientVar) History(key interface{}, from time.Time, to time.Time, limit int) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+
+	op := &TransactionOperation_History{
+		Source:      v.variable,
+		Key:         toObject(key),
+		Destination: nv.variable,
+		Limit:       pb.Uint32(uint32(limit)),
+	}
+	if !from.IsZero() {
+		op.From = pb.Int64(from.UnixNano())
+	}
+	if !to.IsZero() {
+		op.To = pb.Int64(to.UnixNano())
+	}
+
+	b.addOperation(&TransactionOperation{History: op})
+	return nv
+}
+
+// Runs the body for each value of the array, bound to item. Returns the
+// array of the items once the body ran on them, so that maps modified by Set
+// can be stored or returned. The body stops the transaction if it returns.
+func (v *clientVar) ForEach(body func(b Block, item BlockVariable)) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+
+	op := &TransactionOperation_ForEach{
+		Source:      v.variable,
+		Destination: nv.variable,
+	}
+	b.addOperation(&TransactionOperation{ForEach: op})
+
+	op.Body = b.buildChild(func(child Block) {
+		item := b.newClientVariable()
+		op.Item = item.variable
+		body(child, item)
+	}).Id
+
+	return nv
+}
+
+// Returns rows of the table having the given value in an indexed field
+func (v *clientVar) Lookup(field string, value interface{}) BlockVariable {
+	b := v.getBlock()
+	nv := b.newClientVariable()
+	b.addOperation(&TransactionOperation{
+		Lookup: &TransactionOperation_Lookup{
+			Source:      v.variable,
+			Field:       toObject(field),
+			Value:       toObject(value),
+			Destination: nv.variable,
+		},
+	})
+	return nv
+}
+
 //type TransactionReturn struct {
 //	Error            *TransactionError   `protobuf:"bytes,1,opt,name=error"`
 //	Data             []*TransactionValue `protobuf:"bytes,2,rep,name=data"`
@@ -2,8 +2,13 @@ package mry
 
 import (
 	pb "code.google.com/p/goprotobuf/proto"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"github.com/appaquet/nrv"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Transaction execution context that encapsulate everything
@@ -17,6 +22,12 @@ type transactionContext struct {
 	logger     nrv.Logger
 	vars       map[string]*serverVariable
 	token      *nrv.Token
+	block      *TransactionBlock
+
+	// depth of blocks that may not run (if branches, forEach bodies) and the
+	// first token found in them, used only if no other token is found
+	conditional      int
+	conditionalToken *nrv.Token
 }
 
 func (tc *transactionContext) setError(message string, params ...interface{}) {
@@ -45,6 +56,39 @@ func (tc *transactionContext) getServerVariable(variable *TransactionVariable) *
 	return sv
 }
 
+// Resolves the token of a key of a top-level table, or sets an error and
+// returns false if it conflicts with the token already resolved. In dry
+// mode, keys of blocks that may not run can't conflict since only one of
+// them may be accessed for real, which the real execution checks.
+func (tc *transactionContext) resolveToken(key string) bool {
+	token := nrv.HashToken(key)
+	if tc.dry && tc.conditional > 0 {
+		if tc.conditionalToken == nil {
+			tc.conditionalToken = &token
+		}
+		return true
+	}
+
+	if tc.token != nil && *tc.token != token {
+		tc.setError("Token conflict: %s!=%s", token, *tc.token)
+		return false
+	}
+	tc.token = &token
+	return true
+}
+
+// Returns the child block of the block being executed with the given id, or
+// nil after setting an error if there's none
+func (tc *transactionContext) getChildBlock(id uint32) *TransactionBlock {
+	// child blocks are created after their parent, which prevents cycles
+	block := tc.trx.getBlock(id)
+	if block == nil || block.Parent == nil || *block.Parent.Id != *tc.block.Id || *block.Id <= *tc.block.Id {
+		tc.setError("Block %d isn't a child block of block %d", id, *tc.block.Id)
+		return nil
+	}
+	return block
+}
+
 //
 // Operations 
 //
@@ -64,6 +108,31 @@ func (o *TransactionOperation) execute(context *transactionContext) (stop bool)
 	case o.Getall != nil:
 		o.Getall.execute(o, context)
 		return false
+	case o.Delete != nil:
+		o.Delete.execute(o, context)
+		return false
+	case o.Lookup != nil:
+		o.Lookup.execute(o, context)
+		return false
+	case o.Query != nil:
+		o.Query.execute(o, context)
+		return false
+	case o.History != nil:
+		o.History.execute(o, context)
+		return false
+	case o.Filter != nil:
+		o.Filter.execute(o, context)
+		return false
+	case o.Order != nil:
+		o.Order.execute(o, context)
+		return false
+	case o.Limit != nil:
+		o.Limit.execute(o, context)
+		return false
+	case o.If != nil:
+		return o.If.execute(o, context)
+	case o.ForEach != nil:
+		return o.ForEach.execute(o, context)
 
 	case o.Return != nil:
 		o.Return.execute(o, context)
@@ -74,6 +143,97 @@ func (o *TransactionOperation) execute(context *transactionContext) (stop bool)
 	return true
 }
 
+func (oi *TransactionOperation_If) execute(op *TransactionOperation, context *transactionContext) (stop bool) {
+	var blocks []*TransactionBlock
+	for _, id := range []*uint32{oi.ThenBlock, oi.ElseBlock} {
+		if id == nil {
+			blocks = append(blocks, nil)
+			continue
+		}
+
+		block := context.getChildBlock(*id)
+		if block == nil {
+			return true
+		}
+		blocks = append(blocks, block)
+	}
+
+	// conditions can't be evaluated without data, so every block gets run
+	// to find the token of their operations, which can't conflict since
+	// only one of them runs for real
+	if context.dry {
+		context.conditional++
+		defer func() { context.conditional-- }()
+		for _, block := range blocks {
+			if block != nil && block.execute(context) && context.ret.Error != nil {
+				return true
+			}
+		}
+		return false
+	}
+
+	condition, err := newServerPredicate(context, oi.Condition)
+	if err != nil {
+		context.setError("Invalid 'if' condition: %s", err)
+		return true
+	}
+
+	block := blocks[1]
+	if condition.matchesValue(nil) {
+		block = blocks[0]
+	}
+
+	if block == nil {
+		context.logger.Debug("Executing 'if', no block to run")
+		return false
+	}
+
+	context.logger.Debug("Executing 'if', running block %d", *block.Id)
+	return block.execute(context)
+}
+
+func (of *TransactionOperation_ForEach) execute(op *TransactionOperation, context *transactionContext) (stop bool) {
+	body := context.getChildBlock(*of.Body)
+	if body == nil {
+		return true
+	}
+
+	sourceVar := context.getServerVariable(of.Source)
+	itemVar := context.getServerVariable(of.Item)
+	destVar := context.getServerVariable(of.Destination)
+
+	// values aren't known, so the body gets run once to find the token of
+	// its operations, which can't conflict since it may not run for real
+	if context.dry {
+		context.conditional++
+		defer func() { context.conditional-- }()
+		itemVar.value = &nilValue{}
+		destVar.value = &arrayValue{&TransactionCollection{}, nil}
+		return body.execute(context) && context.ret.Error != nil
+	}
+
+	handler, ok := sourceVar.value.(forEachHandler)
+	if !ok {
+		context.setError("Cannot execute forEach on that variable")
+		return true
+	}
+
+	items := &TransactionCollection{}
+	handler.forEach(context, func(value serverValue) bool {
+		itemVar.value = value
+		if body.execute(context) {
+			stop = true
+			return false
+		}
+
+		items.Add(&TransactionCollectionValue{Value: itemVar.value.toTransactionValue()})
+		return true
+	})
+
+	destVar.value = &arrayValue{items, nil}
+	return stop
+}
+
 func (og *TransactionOperation_Get) execute(op *TransactionOperation, context *transactionContext) {
 	sourceVar := context.getServerVariable(og.Source)
 	if handler, ok := sourceVar.value.(getHandler); ok {
@@ -88,13 +248,150 @@ func (og *TransactionOperation_Get) execute(op *TransactionOperation, context *t
 func (os *TransactionOperation_Set) execute(op *TransactionOperation, context *transactionContext) {
 	destVar := context.getServerVariable(os.Destination)
 	if handler, ok := destVar.value.(setHandler); ok {
-		handler.set(context, os.Key.getValue(context).ToInterface(), toServerValue(os.Value.getValue(context)))
+		var ttl time.Duration
+		if os.Ttl != nil {
+			ttl = time.Duration(*os.Ttl)
+		}
+		handler.set(context, os.Key.getValue(context).ToInterface(), toServerValue(os.Value.getValue(context)), ttl)
 
 	} else if !context.dry {
 		context.setError("Cannot execute set on that variable")
 	}
 }
 
+func (od *TransactionOperation_Delete) execute(op *TransactionOperation, context *transactionContext) {
+	destVar := context.getServerVariable(od.Destination)
+	if handler, ok := destVar.value.(deleteHandler); ok {
+		handler.delete(context, od.Key.getValue(context).ToInterface())
+
+	} else if !context.dry {
+		context.setError("Cannot execute delete on that variable")
+	}
+}
+
+func (ol *TransactionOperation_Lookup) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(ol.Source)
+	if handler, ok := sourceVar.value.(lookupHandler); ok {
+		destVar := context.getServerVariable(ol.Destination)
+		field := fmt.Sprint(ol.Field.getValue(context).ToInterface())
+		handler.lookup(context, field, ol.Value.getValue(context).ToInterface(), destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute lookup on that variable")
+	}
+}
+
+func (oq *TransactionOperation_Query) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(oq.Source)
+	if handler, ok := sourceVar.value.(queryHandler); ok {
+		query := StorageQuery{
+			StartExclusive: oq.StartExclusive != nil && *oq.StartExclusive,
+			EndExclusive:   oq.EndExclusive != nil && *oq.EndExclusive,
+			Reverse:        oq.Reverse != nil && *oq.Reverse,
+		}
+		if oq.StartKey != nil {
+			query.StartKey = fmt.Sprint(oq.StartKey.getValue(context).ToInterface())
+		}
+		if oq.EndKey != nil {
+			query.EndKey = fmt.Sprint(oq.EndKey.getValue(context).ToInterface())
+		}
+		if oq.Limit != nil {
+			query.Limit = int(*oq.Limit)
+		}
+
+		destVar := context.getServerVariable(oq.Destination)
+		handler.query(context, query, destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute query on that variable")
+	}
+}
+
+func (oh *TransactionOperation_History) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(oh.Source)
+	if handler, ok := sourceVar.value.(historyHandler); ok {
+		var from, to time.Time
+		if oh.From != nil {
+			from = time.Unix(0, *oh.From)
+		}
+		if oh.To != nil {
+			to = time.Unix(0, *oh.To)
+		}
+		limit := 0
+		if oh.Limit != nil {
+			limit = int(*oh.Limit)
+		}
+
+		destVar := context.getServerVariable(oh.Destination)
+		handler.history(context, oh.Key.getValue(context).ToInterface(), from, to, limit, destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute history on that variable")
+	}
+}
+
+func (of *TransactionOperation_Filter) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(of.Source)
+	if handler, ok := sourceVar.value.(filterHandler); ok {
+		// values of the predicate may only be known for real
+		var predicate *serverPredicate
+		if !context.dry {
+			var err error
+			predicate, err = newServerPredicate(context, of.Predicate)
+			if err != nil {
+				context.setError("Invalid predicate: %s", err)
+				return
+			}
+		}
+
+		destVar := context.getServerVariable(of.Destination)
+		handler.filter(context, predicate, destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute filter on that variable")
+	}
+}
+
+func (oo *TransactionOperation_Order) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(oo.Source)
+	if handler, ok := sourceVar.value.(orderHandler); ok {
+		for _, ordering := range oo.Orderings {
+			if ordering.Field == nil {
+				context.setError("Ordering has no field")
+				return
+			}
+		}
+
+		destVar := context.getServerVariable(oo.Destination)
+		handler.order(context, oo.Orderings, destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute order on that variable")
+	}
+}
+
+func (ol *TransactionOperation_Limit) execute(op *TransactionOperation, context *transactionContext) {
+	sourceVar := context.getServerVariable(ol.Source)
+	if handler, ok := sourceVar.value.(limitHandler); ok {
+		// count may only be known for real
+		var count int64
+		if !context.dry {
+			var ok bool
+			count, ok = toInt64(ol.Count.getValue(context).ToInterface())
+			if !ok || count < 0 {
+				context.setError("Limit needs a positive integer count")
+				return
+			}
+		}
+
+		destVar := context.getServerVariable(ol.Destination)
+		handler.limit(context, int(count), destVar)
+
+	} else if !context.dry {
+		context.setError("Cannot execute limit on that variable")
+	}
+}
+
 func (os *TransactionOperation_GetTable) execute(op *TransactionOperation, context *transactionContext) {
 	// TODO: handle if os.From != nil, we get table in relation with another object 
 
@@ -143,6 +440,31 @@ func (os *TransactionOperation_Return) execute(op *TransactionOperation, context
 
 func (og *TransactionOperation_GetAll) execute(op *TransactionOperation, context *transactionContext) {
 	sourceVar := context.getServerVariable(og.Source)
+
+	// paginated
+	if og.PageSize != nil && *og.PageSize > 0 {
+		if handler, ok := sourceVar.value.(getPageHandler); ok {
+			cursor := ""
+			if og.Cursor != nil {
+				iCursor := og.Cursor.getValue(context).ToInterface()
+				if strCursor, ok := iCursor.(string); ok {
+					cursor = strCursor
+				} else if iCursor != nil {
+					context.setError("Cursor should be a string, got %s", iCursor)
+					return
+				}
+			}
+
+			destVar := context.getServerVariable(og.Destination)
+			cursorVar := context.getServerVariable(og.CursorDestination)
+			handler.getPage(context, int(*og.PageSize), cursor, destVar, cursorVar)
+
+		} else if !context.dry {
+			context.setError("Cannot execute getAll with page size on that variable")
+		}
+		return
+	}
+
 	if handler, ok := sourceVar.value.(getAllHandler); ok {
 		destVar := context.getServerVariable(og.Destination)
 		handler.getAll(context, destVar)
@@ -168,16 +490,74 @@ type getAllHandler interface {
 	getAll(context *transactionContext, destination *serverVariable)
 }
 
+// Represents a value on which we can execute "GetAll" with a page size
+type getPageHandler interface {
+	serverValue
+	getPage(context *transactionContext, pageSize int, cursor string, destination *serverVariable, cursorDestination *serverVariable)
+}
+
 // Represents a value on which we can execute "GetTable"
 type getTableHandler interface {
 	serverValue
 	getTable(context *transactionContext, key interface{}, destination *serverVariable)
 }
 
-// Represents a value on which we can execute "Set"
+// Represents a value on which we can execute "Set", with a time to live
+// if not zero
 type setHandler interface {
 	serverValue
-	set(context *transactionContext, key interface{}, value serverValue)
+	set(context *transactionContext, key interface{}, value serverValue, ttl time.Duration)
+}
+
+// Represents a value on which we can execute "Delete"
+type deleteHandler interface {
+	serverValue
+	delete(context *transactionContext, key interface{})
+}
+
+// Represents a value on which we can execute "Query", the table and
+// prefix of the query being given by the value
+type queryHandler interface {
+	serverValue
+	query(context *transactionContext, query StorageQuery, destination *serverVariable)
+}
+
+// Represents a value on which we can execute "History"
+type historyHandler interface {
+	serverValue
+	history(context *transactionContext, key interface{}, from time.Time, to time.Time, limit int, destination *serverVariable)
+}
+
+// Represents a value on which we can execute "Filter", the predicate being
+// nil in dry mode
+type filterHandler interface {
+	serverValue
+	filter(context *transactionContext, predicate *serverPredicate, destination *serverVariable)
+}
+
+// Represents a value on which we can execute "Order"
+type orderHandler interface {
+	serverValue
+	order(context *transactionContext, orderings []*TransactionOrdering, destination *serverVariable)
+}
+
+// Represents a value on which we can execute "Limit"
+type limitHandler interface {
+	serverValue
+	limit(context *transactionContext, count int, destination *serverVariable)
+}
+
+// Represents a value on which we can execute "ForEach", the callback
+// returning false to stop the iteration
+type forEachHandler interface {
+	serverValue
+	forEach(context *transactionContext, cb func(value serverValue) bool)
+}
+
+// Represents a value on which we can execute "Lookup"
+type lookupHandler interface {
+	serverValue
+	lookup(context *transactionContext, field string, value interface{}, destination *serverVariable)
 }
 
 //
@@ -195,6 +575,8 @@ type serverValue interface {
 
 func toServerValue(val *TransactionValue) serverValue {
 	switch {
+	case val == nil:
+		return &nilValue{}
 	case val.StringValue != nil:
 		return &stringValue{*val.StringValue}
 	case val.IntValue != nil:
@@ -203,10 +585,11 @@ func toServerValue(val *TransactionValue) serverValue {
 		return &mapValue{val.Map, nil}
 	case val.Array != nil:
 		return &arrayValue{val.Array, nil}
+	case val.BoolValue != nil, val.DoubleValue != nil, val.BytesValue != nil:
+		return &basicValue{val}
 	}
 
-	panic(fmt.Sprintf("Unsupported server value: %s", val))
-	return nil
+	return &nilValue{}
 }
 
 // Represents a nil value
@@ -217,6 +600,15 @@ func (v *nilValue) toTransactionValue() *TransactionValue {
 	return toTransactionValue(nil)
 }
 
+// Represents a value without operations, such as a bool, a double or bytes
+type basicValue struct {
+	value *TransactionValue
+}
+
+func (bv *basicValue) toTransactionValue() *TransactionValue {
+	return bv.value
+}
+
 // Represents a string value
 type stringValue struct {
 	value string
@@ -250,10 +642,97 @@ func (mv *mapValue) getMap() nrv.Map {
 	return mv.value
 }
 
+// Returns the value of a field, or nil if it's missing
+func (mv *mapValue) get(context *transactionContext, key interface{}, destination *serverVariable) {
+	context.logger.Debug("Executing 'get' on map value with key %s", key)
+
+	destination.value = toServerValue(toTransactionValue(mv.getMap()[fmt.Sprint(key)]))
+}
+
+// Sets a field of the map, leaving the row it may have been read from
+// untouched until the map gets stored
+func (mv *mapValue) set(context *transactionContext, key interface{}, value serverValue, ttl time.Duration) {
+	context.logger.Debug("Executing 'set' on map value with key %s", key)
+
+	if ttl > 0 {
+		context.setError("Time to live only applies to rows of tables")
+		return
+	}
+
+	mv.getMap()[fmt.Sprint(key)] = value.toTransactionValue().ToInterface()
+}
+
 func (mv *mapValue) remove(key string) {
 	delete(mv.getMap(), key)
 }
 
+// Removes metadata added to rows (_timestamp, _deleted, _expires and
+// _key1.._keyN)
+func (mv *mapValue) removeRowMetadata() {
+	m := mv.getMap()
+	for key := range m {
+		if isRowMetadata(key) {
+			delete(m, key)
+		}
+	}
+}
+
+func isRowMetadata(key string) bool {
+	if key == "_timestamp" || key == "_deleted" || key == rowExpiresField {
+		return true
+	}
+
+	if !strings.HasPrefix(key, "_key") {
+		return false
+	}
+	_, err := strconv.Atoi(key[len("_key"):])
+	return err == nil
+}
+
+// Field of row values holding the time at which the row expires, in
+// nanoseconds
+const rowExpiresField = "_expires"
+
+// Returns true if the value is a row that expired at the given time
+func valueExpired(val *TransactionValue, now time.Time) bool {
+	expires, found := valueExpiry(val)
+	return found && expires <= now.UnixNano()
+}
+
+// Returns the time at which the value, a row, expires, if it has any
+func valueExpiry(val *TransactionValue) (int64, bool) {
+	m, ok := val.ToInterface().(nrv.Map)
+	if !ok {
+		return 0, false
+	}
+
+	switch expires := m[rowExpiresField].(type) {
+	case int64:
+		return expires, true
+	case uint64:
+		return int64(expires), true
+	case int:
+		return int64(expires), true
+	}
+	return 0, false
+}
+
+// Returns the value of a row as returned to clients, with its keys and
+// timestamp but without the expiry it's stored with
+func rowReturnValue(val *TransactionValue, row *Row) *TransactionValue {
+	m, ok := val.ToInterface().(nrv.Map)
+	if !ok {
+		return val
+	}
+
+	delete(m, rowExpiresField)
+	m["_timestamp"] = row.IntTimestamp
+	for i, key := range row.Keys {
+		m["_key"+strconv.Itoa(i+1)] = key
+	}
+	return toTransactionValue(m)
+}
+
 func (mv *mapValue) toTransactionValue() *TransactionValue {
 	// if interface is set, value may have changed
 	if mv.value != nil {
@@ -282,9 +761,87 @@ func (av *arrayValue) toTransactionValue() *TransactionValue {
 	}
 }
 
+func (av *arrayValue) forEach(context *transactionContext, cb func(value serverValue) bool) {
+	context.logger.Debug("Executing 'forEach' on array value")
+
+	array := av.toTransactionValue().Array
+	if array == nil {
+		return
+	}
+
+	for _, value := range array.Values {
+		if !cb(toServerValue(value.Value)) {
+			return
+		}
+	}
+}
+
+func (av *arrayValue) filter(context *transactionContext, predicate *serverPredicate, destination *serverVariable) {
+	context.logger.Debug("Executing 'filter' on array value")
+
+	if !context.dry {
+		values := make([]*TransactionCollectionValue, 0)
+		if array := av.toTransactionValue().Array; array != nil {
+			for _, value := range array.Values {
+				if value.Value != nil && predicate.matchesValue(value.Value.ToInterface()) {
+					values = append(values, value)
+				}
+			}
+		}
+
+		destination.value = &arrayValue{value: &TransactionCollection{Values: values}}
+	}
+}
+
+func (av *arrayValue) order(context *transactionContext, orderings []*TransactionOrdering, destination *serverVariable) {
+	context.logger.Debug("Executing 'order' on array value")
+
+	values := make([]*TransactionCollectionValue, 0)
+	if array := av.toTransactionValue().Array; array != nil {
+		values = append(values, array.Values...)
+	}
+
+	destination.value = &arrayValue{value: &TransactionCollection{Values: orderValues(values, orderings)}}
+}
+
+func (av *arrayValue) limit(context *transactionContext, count int, destination *serverVariable) {
+	context.logger.Debug("Executing 'limit' on array value with count %d", count)
+
+	if !context.dry {
+		values := make([]*TransactionCollectionValue, 0)
+		if array := av.toTransactionValue().Array; array != nil {
+			values = array.Values
+		}
+		if len(values) > count {
+			values = values[:count]
+		}
+
+		destination.value = &arrayValue{value: &TransactionCollection{Values: values}}
+	}
+}
+
 // Query that can be executed on a storage
 type queryValue struct {
 	query *StorageQuery
+
+	// Predicate rows need to match, if any
+	predicate *serverPredicate
+}
+
+// Returns a query on the rows of the query that also match the predicate,
+// bounded to the keys it can match
+func (qv *queryValue) filter(context *transactionContext, predicate *serverPredicate, destination *serverVariable) {
+	context.logger.Debug("Executing 'filter' on query value %s", qv)
+
+	query := *qv.query
+	if predicate != nil {
+		predicate.narrowQuery(&query)
+	}
+
+	destination.value = &queryValue{
+		query:     &query,
+		predicate: andServerPredicates(qv.predicate, predicate),
+	}
 }
 
 func (qv *queryValue) toTransactionValue() *TransactionValue {
@@ -301,41 +858,194 @@ func (qv *queryValue) getAll(context *transactionContext, destination *serverVar
 	}
 
 	if !context.dry {
-		iterator, err := context.storageTrx.GetQuery(*qv.query)
-		if err != nil {
-			context.setError("Got a storage error executing getquery: %s", err)
+		values, _, ok := qv.execute(context, *qv.query)
+		if !ok {
 			return
 		}
 
-		collection := &TransactionCollection{}
+		destination.value = &arrayValue{value: &TransactionCollection{Values: values}}
+	}
+}
 
-		for {
-			row, err := iterator.Next()
-			if row != nil && err == nil {
-				val := &TransactionValue{}
-				marshErr := val.Unmarshall(row.Data)
-				if marshErr != nil {
-					context.setError("Couldn't unmarshall value: %s", marshErr)
-					iterator.Close()
-					return
-				}
+// Returns a page of the query's rows, resuming after the cursor at the
+// snapshot time of the first page. The query's limit is ignored.
+func (qv *queryValue) getPage(context *transactionContext, pageSize int, cursor string, destination *serverVariable, cursorDestination *serverVariable) {
+	context.logger.Debug("Executing 'getAll' on query value %s with page size %d", qv, pageSize)
 
-				collection.Add(&TransactionCollectionValue{Value: val})
-			} else if err != nil {
-				context.setError("Got a storage error iterating over 'getall': %s", err)
-				iterator.Close()
+	// if no prefix, we are at top level
+	if len(qv.query.TablePrefix) == 0 {
+		context.setError("'getAll' not supported on top level tables")
+		return
+	}
+
+	if !context.dry {
+		query := *qv.query
+		query.Time = context.trx.readTime()
+
+		if cursor != "" {
+			trxCursor, err := decodeCursor(cursor)
+			if err != nil {
+				context.setError("Invalid cursor: %s", err)
 				return
-			} else if row == nil {
-				break
+			}
+
+			if *trxCursor.Table != query.Table.Path() || strings.Join(trxCursor.Prefix, "\x00") != strings.Join(query.TablePrefix, "\x00") {
+				context.setError("Cursor was created for another query")
+				return
+			}
+
+			// the cursor comes from the client, which can't read past the
+			// transaction's read time
+			if cursorTime := time.Unix(0, *trxCursor.Time); cursorTime.Before(query.Time) {
+				query.Time = cursorTime
+			}
+
+			if query.Reverse {
+				query.EndKey = *trxCursor.LastKey
+				query.EndExclusive = true
+			} else {
+				query.StartKey = *trxCursor.LastKey
+				query.StartExclusive = true
 			}
 		}
 
-		iterator.Close()
+		// fetch one more row to know if there is a next page
+		query.Limit = pageSize + 1
+		values, keys, ok := qv.execute(context, query)
+		if !ok {
+			return
+		}
 
-		destination.value = &arrayValue{value: collection}
+		cursorDestination.value = &nilValue{}
+		if len(values) > pageSize {
+			values = values[:pageSize]
+
+			nextCursor, err := encodeCursor(&TransactionCursor{
+				Table:   pb.String(query.Table.Path()),
+				Prefix:  query.TablePrefix,
+				Time:    pb.Int64(query.Time.UnixNano()),
+				LastKey: pb.String(keys[pageSize-1]),
+			})
+			if err != nil {
+				context.setError("Couldn't encode cursor: %s", err)
+				return
+			}
+			cursorDestination.value = &stringValue{nextCursor}
+		}
+
+		destination.value = &arrayValue{value: &TransactionCollection{Values: values}}
 	}
 }
 
+// Executes the query on the storage, returning the values of the rows and
+// their last key. Returns false on error.
+func (qv *queryValue) execute(context *transactionContext, query StorageQuery) ([]*TransactionCollectionValue, []string, bool) {
+	readTime := context.trx.readTime()
+	if !query.Time.IsZero() {
+		readTime = query.Time
+	}
+
+	values := make([]*TransactionCollectionValue, 0)
+	keys := make([]string, 0)
+
+	// the storage limits rows before expired and unmatched ones are
+	// skipped, so rows missing are queried after the last one read
+	limit := query.Limit
+	for {
+		query.Limit = 0
+		if limit > 0 {
+			query.Limit = limit - len(values)
+		}
+
+		read, lastKey, ok := qv.executeBatch(context, query, readTime, &values, &keys)
+		if !ok {
+			return nil, nil, false
+		} else if limit == 0 || len(values) >= limit || read < query.Limit {
+			return values, keys, true
+		}
+
+		if query.Reverse {
+			query.EndKey = lastKey
+			query.EndExclusive = true
+		} else {
+			query.StartKey = lastKey
+			query.StartExclusive = true
+		}
+	}
+}
+
+// Executes a query on the storage, adding the values of the rows that
+// aren't expired and match the predicate. Returns the number of rows read
+// and the last key read, or false on error.
+func (qv *queryValue) executeBatch(context *transactionContext, query StorageQuery, readTime time.Time, values *[]*TransactionCollectionValue, keys *[]string) (int, string, bool) {
+	iterator, err := context.storageTrx.GetQuery(query)
+	if err != nil {
+		context.setError("Got a storage error executing getquery: %s", err)
+		return 0, "", false
+	}
+	defer iterator.Close()
+
+	read := 0
+	lastKey := ""
+	for {
+		row, err := iterator.Next()
+		if err != nil {
+			context.setError("Got a storage error iterating over 'getall': %s", err)
+			return 0, "", false
+		} else if row == nil {
+			return read, lastKey, true
+		}
+
+		read++
+		lastKey = row.Keys[len(row.Keys)-1]
+
+		val := &TransactionValue{}
+		err = val.unmarshallRow(row.Data)
+		if err != nil {
+			context.setError("Couldn't unmarshall value: %s", err)
+			return 0, "", false
+		}
+
+		if valueExpired(val, readTime) {
+			continue
+		}
+
+		if qv.predicate != nil && !qv.predicate.matchesRow(val.ToInterface(), row) {
+			continue
+		}
+
+		// rows carry their keys and timestamp, as rows got by key
+		*values = append(*values, &TransactionCollectionValue{Value: rowReturnValue(val, row)})
+		*keys = append(*keys, lastKey)
+	}
+}
+
+func encodeCursor(cursor *TransactionCursor) (string, error) {
+	bytes, err := pb.Marshal(cursor)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+func decodeCursor(cursor string) (*TransactionCursor, error) {
+	bytes, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	trxCursor := &TransactionCursor{}
+	err = pb.Unmarshal(bytes, trxCursor)
+	if err != nil {
+		return nil, err
+	}
+
+	if trxCursor.Table == nil || trxCursor.Time == nil || trxCursor.LastKey == nil {
+		return nil, errors.New("missing fields")
+	}
+	return trxCursor, nil
+}
+
 // Table
 type tableValue struct {
 	table  *Table 
@@ -348,13 +1058,8 @@ func (tv *tableValue) get(context *transactionContext, key interface{}, destinat
 	strKey := fmt.Sprint(key)
 
 	// if no prefix, we resolve token
-	if len(tv.prefix) == 0 {
-		token := nrv.HashToken(strKey)
-		if context.token != nil && *context.token != token {
-			context.setError("Token conflict: %s!=%s", token, *context.token)
-			return
-		}
-		context.token = &token
+	if len(tv.prefix) == 0 && !context.resolveToken(strKey) {
+		return
 	}
 
 	row := &rowValue{
@@ -369,35 +1074,46 @@ func (tv *tableValue) get(context *transactionContext, key interface{}, destinat
 	destination.value = row
 }
 
-func (tv *tableValue) set(context *transactionContext, key interface{}, value serverValue) {
+func (tv *tableValue) set(context *transactionContext, key interface{}, value serverValue, ttl time.Duration) {
 	context.logger.Debug("Executing 'set' on table %s with key %s, prefix %s", tv.table, key, tv.prefix)
 
+	if context.trx.readOnly() {
+		context.setError("Can't set into table %s, transaction is read-only", tv.table)
+		return
+	}
+
 	strKey := fmt.Sprint(key)
 
 	// if no prefix, we resolve token
-	if len(tv.prefix) == 0 {
-		token := nrv.HashToken(strKey)
-		if context.token != nil && *context.token != token {
-			context.setError("Token conflict: %s!=%s", token, *context.token)
-			return
-		}
-		context.token = &token
+	if len(tv.prefix) == 0 && !context.resolveToken(strKey) {
+		return
 	}
 
 	if mapVal, isMap := value.(*mapValue); isMap {
 		if !context.dry {
-			mapVal.remove("_timestamp")
-			mapVal.remove("_key1")
-			mapVal.remove("_key2")
-			mapVal.remove("_key3")
-			mapVal.remove("_key4")
+			mapVal.removeRowMetadata()
+
+			// a set replaces the expiry of the row
+			delete(mapVal.getMap(), rowExpiresField)
+			if ttl <= 0 {
+				ttl = tv.table.TTL
+			}
+			if ttl > 0 {
+				mapVal.getMap()[rowExpiresField] = time.Unix(0, int64(*context.trx.Id)).Add(ttl).UnixNano()
+				context.db.markExpiring(tv.table)
+			}
 
-			bytes, err := mapVal.toTransactionValue().Marshall()
+			bytes, err := mapVal.toTransactionValue().marshallRow(context.db.Codec)
 			if err != nil {
 				context.setError("Couldn't marshall value: %s", err)
 				return
 			}
 
+			if maxSize := context.db.maxValueSize(); len(bytes) > maxSize {
+				context.setError("Value of %d bytes for key %s exceeds the maximum value size of %d bytes", len(bytes), key, maxSize)
+				return
+			}
+
 			l := len(tv.prefix) + 1
 			keys := make([]string, l)
 			for i := 0; i < l-1; i++ {
@@ -405,6 +1121,10 @@ func (tv *tableValue) set(context *transactionContext, key interface{}, value se
 			}
 			keys[l-1] = fmt.Sprintf("%s", key)
 
+			if !tv.updateIndexes(context, keys, mapVal.getMap()) {
+				return
+			}
+
 			err = context.storageTrx.Set(tv.table, keys, bytes)
 			if err != nil {
 				context.setError("Couldn't set value into table: %s", err)
@@ -412,12 +1132,44 @@ func (tv *tableValue) set(context *transactionContext, key interface{}, value se
 			}
 		}
 
-	} else {
+	} else if !context.dry {
 		context.setError("Can only store a map into table")
 		return
 	}
 }
 
+func (tv *tableValue) delete(context *transactionContext, key interface{}) {
+	context.logger.Debug("Executing 'delete' on table %s with key %s, prefix %s", tv.table, key, tv.prefix)
+
+	if context.trx.readOnly() {
+		context.setError("Can't delete from table %s, transaction is read-only", tv.table)
+		return
+	}
+
+	strKey := fmt.Sprint(key)
+
+	// if no prefix, we resolve token
+	if len(tv.prefix) == 0 && !context.resolveToken(strKey) {
+		return
+	}
+
+	if !context.dry {
+		keys := make([]string, len(tv.prefix)+1)
+		copy(keys, tv.prefix)
+		keys[len(keys)-1] = strKey
+
+		if !tv.updateIndexes(context, keys, nil) {
+			return
+		}
+
+		err := context.storageTrx.Delete(tv.table, keys)
+		if err != nil {
+			context.setError("Couldn't delete value from table: %s", err)
+			return
+		}
+	}
+}
+
 func (tv *tableValue) getAll(context *transactionContext, destination *serverVariable) {
 	context.logger.Debug("Executing 'getAll' on table %s, prefix %s", tv.table, tv.prefix)
 
@@ -428,7 +1180,7 @@ func (tv *tableValue) getAll(context *transactionContext, destination *serverVar
 	}
 
 	if !context.dry {
-		queryVal := &queryValue{&StorageQuery{
+		queryVal := &queryValue{query: &StorageQuery{
 			Table:       tv.table,
 			TablePrefix: tv.prefix,
 		}}
@@ -437,6 +1189,210 @@ func (tv *tableValue) getAll(context *transactionContext, destination *serverVar
 	}
 }
 
+func (tv *tableValue) getPage(context *transactionContext, pageSize int, cursor string, destination *serverVariable, cursorDestination *serverVariable) {
+	queryVal := &queryValue{query: &StorageQuery{
+		Table:       tv.table,
+		TablePrefix: tv.prefix,
+	}}
+
+	queryVal.getPage(context, pageSize, cursor, destination, cursorDestination)
+}
+
+func (tv *tableValue) filter(context *transactionContext, predicate *serverPredicate, destination *serverVariable) {
+	context.logger.Debug("Executing 'filter' on table %s, prefix %s", tv.table, tv.prefix)
+
+	queryVal := &queryValue{query: &StorageQuery{
+		Table:       tv.table,
+		TablePrefix: tv.prefix,
+	}}
+
+	queryVal.filter(context, predicate, destination)
+}
+
+func (tv *tableValue) query(context *transactionContext, query StorageQuery, destination *serverVariable) {
+	context.logger.Debug("Executing 'query' on table %s, prefix %s", tv.table, tv.prefix)
+
+	query.Table = tv.table
+	query.TablePrefix = tv.prefix
+	destination.value = &queryValue{query: &query}
+}
+
+func (tv *tableValue) lookup(context *transactionContext, field string, value interface{}, destination *serverVariable) {
+	context.logger.Debug("Executing 'lookup' on table %s with %s=%s, prefix %s", tv.table, field, value, tv.prefix)
+
+	// if no prefix, we are at top level
+	if len(tv.prefix) == 0 {
+		context.setError("'lookup' not supported on top level tables")
+		return
+	}
+
+	index := tv.table.GetIndex(field)
+	if index == nil {
+		context.setError("No index on field %s of table %s", field, tv.table.Name)
+		return
+	}
+
+	if !context.dry {
+		iterator, err := context.storageTrx.GetQuery(StorageQuery{
+			Table:       index.table,
+			TablePrefix: append(append([]string{}, tv.prefix...), indexValueKey(value)),
+		})
+		if err != nil {
+			context.setError("Got a storage error executing lookup: %s", err)
+			return
+		}
+
+		// collect keys first, the storage may not allow a get while iterating
+		rowKeys := make([]string, 0)
+		for {
+			entry, err := iterator.Next()
+			if err != nil {
+				context.setError("Got a storage error iterating over 'lookup': %s", err)
+				iterator.Close()
+				return
+			} else if entry == nil {
+				break
+			}
+
+			rowKeys = append(rowKeys, entry.Keys[len(entry.Keys)-1])
+		}
+		iterator.Close()
+
+		collection := &TransactionCollection{}
+		for _, rowKey := range rowKeys {
+			row, err := context.storageTrx.Get(tv.table, append(append([]string{}, tv.prefix...), rowKey))
+			if err != nil {
+				context.setError("Got a storage error getting looked up row: %s", err)
+				return
+			} else if row == nil {
+				continue
+			}
+
+			val := &TransactionValue{}
+			err = val.unmarshallRow(row.Data)
+			if err != nil {
+				context.setError("Couldn't unmarshall value: %s", err)
+				return
+			}
+
+			if valueExpired(val, context.trx.readTime()) {
+				continue
+			}
+
+			// long values share their entry with values having the same hash
+			fields, _ := val.ToInterface().(nrv.Map)
+			if fieldValue, found := fields[field]; !found || indexTypedValue(fieldValue) != indexTypedValue(value) {
+				continue
+			}
+
+			collection.Add(&TransactionCollectionValue{Value: rowReturnValue(val, row)})
+		}
+
+		destination.value = &arrayValue{value: collection}
+	}
+}
+
+func (tv *tableValue) history(context *transactionContext, key interface{}, from time.Time, to time.Time, limit int, destination *serverVariable) {
+	context.logger.Debug("Executing 'history' on table %s with key %s, prefix %s", tv.table, key, tv.prefix)
+
+	strKey := fmt.Sprint(key)
+
+	// if no prefix, we resolve token
+	if len(tv.prefix) == 0 && !context.resolveToken(strKey) {
+		return
+	}
+
+	if !context.dry {
+		keys := make([]string, len(tv.prefix)+1)
+		copy(keys, tv.prefix)
+		keys[len(keys)-1] = strKey
+
+		rows, err := context.storageTrx.GetHistory(tv.table, keys, from, to, limit)
+		if err != nil {
+			context.setError("Got a storage error executing history: %s", err)
+			return
+		}
+
+		collection := &TransactionCollection{}
+		for _, row := range rows {
+			version := nrv.Map{}
+			if row.Deleted() {
+				version["_deleted"] = true
+			} else {
+				val := &TransactionValue{}
+				err = val.unmarshallRow(row.Data)
+				if err != nil {
+					context.setError("Couldn't unmarshall value: %s", err)
+					return
+				}
+
+				if m, ok := val.ToInterface().(nrv.Map); ok {
+					version = m
+					delete(version, rowExpiresField)
+				}
+			}
+
+			version["_timestamp"] = row.IntTimestamp
+			for i, key := range row.Keys {
+				version["_key"+strconv.Itoa(i+1)] = key
+			}
+
+			collection.Add(&TransactionCollectionValue{Value: toTransactionValue(version)})
+		}
+
+		destination.value = &arrayValue{value: collection}
+	}
+}
+
+// Keeps entries of the table's indexes in sync with a row about to be written,
+// newValue being nil if the row is deleted. Returns false on error.
+func (tv *tableValue) updateIndexes(context *transactionContext, keys []string, newValue nrv.Map) bool {
+	if len(tv.table.Indexes()) == 0 {
+		return true
+	}
+
+	var oldValue nrv.Map
+	row, err := context.storageTrx.Get(tv.table, keys)
+	if err != nil {
+		context.setError("Couldn't get previous value of row: %s", err)
+		return false
+	} else if row != nil {
+		trxVal := &TransactionValue{}
+		err = trxVal.unmarshallRow(row.Data)
+		if err != nil {
+			context.setError("Couldn't unmarshall value: %s", err)
+			return false
+		}
+		oldValue, _ = trxVal.ToInterface().(nrv.Map)
+	}
+
+	for _, index := range tv.table.Indexes() {
+		oldField, hadOld := oldValue[index.Field]
+		newField, hasNew := newValue[index.Field]
+		if hadOld && hasNew && indexTypedValue(oldField) == indexTypedValue(newField) {
+			continue
+		}
+
+		if hadOld {
+			err = context.storageTrx.Delete(index.table, index.entryKeys(keys, oldField))
+			if err != nil {
+				context.setError("Couldn't remove index entry: %s", err)
+				return false
+			}
+		}
+
+		if hasNew {
+			err = context.storageTrx.Set(index.table, index.entryKeys(keys, newField), []byte{1})
+			if err != nil {
+				context.setError("Couldn't add index entry: %s", err)
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 func (tv *tableValue) toTransactionValue() *TransactionValue {
 	// TODO: return something else ??
 	return toTransactionValue("TABLE " + tv.table.Name)
@@ -470,6 +1426,20 @@ func (rv *rowValue) getRow() *Row {
 				return nil
 			}
 
+			// expired rows are read as missing
+			if row != nil {
+				val := &TransactionValue{}
+				err = val.unmarshallRow(row.Data)
+				if err != nil {
+					rv.context.setError("Couldn't unmarshall value: %s", err)
+					return nil
+				}
+
+				if valueExpired(val, rv.context.trx.readTime()) {
+					return nil
+				}
+			}
+
 			rv.row = row
 		}
 	}
@@ -482,7 +1452,7 @@ func (rv *rowValue) getSrvValue() *mapValue {
 		row := rv.getRow()
 		trxVal := &TransactionValue{}
 		if row != nil {
-			err := trxVal.Unmarshall(row.Data)
+			err := trxVal.unmarshallRow(row.Data)
 			if err != nil {
 				rv.context.setError("Couldn't unmarshall value: %s", err)
 				return &mapValue{value:nrv.Map{}}
@@ -504,19 +1474,14 @@ func (rv *rowValue) toTransactionValue() *TransactionValue {
 	srvValue := rv.getSrvValue()
 
 	if srvValue != nil {
-		srvValue.remove("_timestamp")
-		srvValue.remove("_key1")
-		srvValue.remove("_key2")
-		srvValue.remove("_key3")
-		srvValue.remove("_key4")
+		srvValue.removeRowMetadata()
 
 		row := rv.getRow()
 		if row != nil && srvValue.value != nil {
 			srvValue.value["_timestamp"] = row.IntTimestamp
-			srvValue.value["_key1"] = row.Key1
-			srvValue.value["_key2"] = row.Key2
-			srvValue.value["_key3"] = row.Key3
-			srvValue.value["_key4"] = row.Key4
+			for i, key := range row.Keys {
+				srvValue.value["_key"+strconv.Itoa(i+1)] = key
+			}
 		}
 
 		return srvValue.toTransactionValue()
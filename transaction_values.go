@@ -108,6 +108,10 @@ func toTransactionValue(o interface{}) *TransactionValue {
 }
 
 func (val *TransactionValue) ToInterface() interface{} {
+	if val == nil {
+		return nil
+	}
+
 	switch {
 	case val.Map != nil:
 		iMap := nrv.NewMap()
@@ -144,6 +148,24 @@ func (val *TransactionValue) Marshall() ([]byte, error) {
 	return pb.Marshal(val)
 }
 
+// Unmarshalls the data of a row, decoding it first if it has a codec header
+func (val *TransactionValue) unmarshallRow(buf []byte) error {
+	decoded, err := decodeRowData(buf)
+	if err != nil {
+		return err
+	}
+	return val.Unmarshall(decoded)
+}
+
+// Marshalls the value as the data of a row, encoded by the codec if not nil
+func (val *TransactionValue) marshallRow(codec Codec) ([]byte, error) {
+	buf, err := val.Marshall()
+	if err != nil {
+		return nil, err
+	}
+	return encodeRowData(codec, buf)
+}
+
 //type TransactionObject struct {
 //	Value            *TransactionValue    `protobuf:"bytes,1,opt,name=value"`
 //	Variable         *TransactionVariable `protobuf:"bytes,2,opt,name=variable"`
@@ -156,6 +178,9 @@ func (o *TransactionObject) getValue(context *transactionContext) *TransactionVa
 		return o.Value
 	}
 	v := context.getServerVariable(o.Variable)
+	if v.value == nil {
+		return nil
+	}
 	return v.value.toTransactionValue()
 }
 